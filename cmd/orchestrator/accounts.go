@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/mail"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gridforce/core/internal/core/db"
+	"gorm.io/gorm"
+)
+
+// Credits granted to a new customer unless the admin sets another amount
+const defaultOpeningCredits = 1000
+
+// keyRequest is the part of a request body describing an API key to issue
+type keyRequest struct {
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`     // default: all scopes
+	ExpiresIn int64    `json:"expires_in"` // seconds; 0 never expires
+}
+
+// build validates the request and prepares the key, returning it with its secret. A key
+// may not grant scopes beyond allowed.
+func (k keyRequest) build(allowed []string) (*db.APIKey, string, error) {
+	if k.Name == "" {
+		k.Name = "default"
+	}
+	scopes := k.Scopes
+	if len(scopes) == 0 {
+		scopes = allowed
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(db.AllScopes, scope) {
+			return nil, "", errors.New("unknown scope " + scope)
+		}
+		if !slices.Contains(allowed, scope) {
+			return nil, "", errors.New("scope " + scope + " exceeds the scopes of the calling key")
+		}
+	}
+	if k.ExpiresIn < 0 {
+		return nil, "", errors.New("expires_in must not be negative")
+	}
+	var expiresAt *time.Time
+	if k.ExpiresIn > 0 {
+		t := time.Now().Add(time.Duration(k.ExpiresIn) * time.Second)
+		expiresAt = &t
+	}
+	secret := generateRandomKey()
+	return db.NewAPIKey(k.Name, secret, scopes, expiresAt), secret, nil
+}
+
+// keyResponse describes a key without its secret
+func keyResponse(key *db.APIKey) map[string]interface{} {
+	return map[string]interface{}{
+		"id":           key.ID,
+		"name":         key.Name,
+		"prefix":       key.Prefix,
+		"scopes":       key.Scopes,
+		"created_at":   key.CreatedAt,
+		"expires_at":   key.ExpiresAt,
+		"revoked_at":   key.RevokedAt,
+		"last_used_at": key.LastUsedAt,
+		"active":       key.Active(),
+	}
+}
+
+// keyResponses describes a list of keys
+func keyResponses(keys []db.APIKey) []map[string]interface{} {
+	out := make([]map[string]interface{}, 0, len(keys))
+	for i := range keys {
+		out = append(out, keyResponse(&keys[i]))
+	}
+	return out
+}
+
+// customerResponse describes a customer account
+func customerResponse(customer *db.Customer) map[string]interface{} {
+	return map[string]interface{}{
+		"id":             customer.ID,
+		"name":           customer.Name,
+		"email":          customer.Email,
+		"credits":        customer.Credits,
+		"created_at":     customer.CreatedAt,
+		"suspended_at":   customer.SuspendedAt,
+		"suspend_reason": customer.SuspendReason,
+	}
+}
+
+// API: Admin Create Customer, with their first API key
+func handleCreateCustomer(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name    string     `json:"name"`
+		Email   string     `json:"email"`
+		Credits *int64     `json:"credits"`
+		Key     keyRequest `json:"key"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+	if req.Email != "" {
+		addr, err := mail.ParseAddress(req.Email)
+		if err != nil {
+			http.Error(w, "Invalid email address", http.StatusBadRequest)
+			return
+		}
+		req.Email = strings.ToLower(addr.Address)
+	}
+	credits := int64(defaultOpeningCredits)
+	if req.Credits != nil {
+		if *req.Credits < 0 {
+			http.Error(w, "Credits must not be negative", http.StatusBadRequest)
+			return
+		}
+		credits = *req.Credits
+	}
+	key, secret, err := req.Key.build(db.AllScopes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	customer := db.Customer{
+		ID:    uuid.New().String(),
+		Name:  req.Name,
+		Email: req.Email,
+	}
+	actor := actorFromContext(r)
+	err = db.CreateCustomer(actor, &customer, credits, key)
+	if errors.Is(err, db.ErrEmailTaken) {
+		http.Error(w, "A customer with this email already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to create customer %s: %v\n", req.Name, err)
+		http.Error(w, "Failed to create customer", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("AUDIT: %s created customer %s (%s) with %d credits\n", actor.Name, customer.ID, customer.Name, credits)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"customer": customerResponse(&customer),
+		"key":      keyResponse(key),
+		"api_key":  secret,
+		"message":  "Customer created successfully; the API key is shown only once",
+	})
+}
+
+// API: Admin List Customers
+func handleListCustomers(w http.ResponseWriter, r *http.Request) {
+	var customers []db.Customer
+	if err := db.DB.Order("created_at desc").Find(&customers).Error; err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	out := make([]map[string]interface{}, 0, len(customers))
+	for i := range customers {
+		out = append(out, customerResponse(&customers[i]))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// API: Admin Get Customer, with their API keys
+func handleGetCustomer(w http.ResponseWriter, r *http.Request) {
+	var customer db.Customer
+	if err := db.DB.First(&customer, "id = ?", r.PathValue("id")).Error; err != nil {
+		http.Error(w, "Customer not found", http.StatusNotFound)
+		return
+	}
+	keys, err := db.APIKeys(customer.ID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	out := customerResponse(&customer)
+	out["keys"] = keyResponses(keys)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// API: Get the caller's account
+func handleGetAccount(w http.ResponseWriter, r *http.Request) {
+	out := customerResponse(customerFromContext(r))
+	out["key"] = keyResponse(apiKeyFromContext(r))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// API: List the caller's API keys
+func handleListKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := db.APIKeys(customerFromContext(r).ID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keyResponses(keys))
+}
+
+// API: Issue the caller a new API key, with at most the scopes of the key calling
+func handleCreateKey(w http.ResponseWriter, r *http.Request) {
+	customer := customerFromContext(r)
+
+	var req keyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	key, secret, err := req.build(apiKeyFromContext(r).Scopes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := db.CreateAPIKey(customer.ID, key); err != nil {
+		http.Error(w, "Failed to create API key", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("API key %s (%s) issued to customer %s\n", key.ID, key.Name, customer.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"key":     keyResponse(key),
+		"api_key": secret,
+	})
+}
+
+// API: Replace one of the caller's API keys with a new secret. The old key keeps working
+// for grace_seconds, so clients can switch over.
+func handleRotateKey(w http.ResponseWriter, r *http.Request) {
+	customer := customerFromContext(r)
+
+	var req struct {
+		GraceSeconds int64 `json:"grace_seconds"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.GraceSeconds < 0 {
+		http.Error(w, "grace_seconds must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	secret := generateRandomKey()
+	grace := time.Duration(req.GraceSeconds) * time.Second
+	key, err := db.RotateAPIKey(customer.ID, r.PathValue("id"), secret, apiKeyFromContext(r).Scopes, grace)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, db.ErrScopeExceeded) {
+		http.Error(w, "Forbidden: API key has scopes the calling key lacks", http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, db.ErrAPIKeyRevoked) || errors.Is(err, db.ErrAPIKeyExpired) {
+		http.Error(w, "API key is no longer active", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to rotate API key", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("API key %s of customer %s rotated to %s (grace %ds)\n", r.PathValue("id"), customer.ID, key.ID, req.GraceSeconds)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"key":     keyResponse(key),
+		"api_key": secret,
+	})
+}
+
+// API: Revoke one of the caller's API keys
+func handleRevokeKey(w http.ResponseWriter, r *http.Request) {
+	customer := customerFromContext(r)
+
+	key, err := db.RevokeAPIKey(customer.ID, r.PathValue("id"))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to revoke API key", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("API key %s of customer %s revoked\n", key.ID, customer.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keyResponse(key))
+}
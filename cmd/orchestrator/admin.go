@@ -0,0 +1,341 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gridforce/core/internal/core/db"
+	"gorm.io/gorm"
+)
+
+// readReason reads the reason an admin gives for an action from an optional JSON body
+func readReason(r *http.Request) (string, error) {
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return "", err
+		}
+	}
+	return strings.TrimSpace(req.Reason), nil
+}
+
+// generateAdminToken returns a new random admin token
+func generateAdminToken() (string, error) {
+	bytes := make([]byte, 24)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return "gfa_" + hex.EncodeToString(bytes), nil
+}
+
+// API: Admin Grant Credits to a customer
+func handleGrantCredits(w http.ResponseWriter, r *http.Request) {
+	actor := actorFromContext(r)
+
+	var req struct {
+		Amount int64  `json:"amount"`
+		Note   string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Amount <= 0 {
+		http.Error(w, "Amount must be positive", http.StatusBadRequest)
+		return
+	}
+	if req.Note == "" {
+		req.Note = "granted by " + actor.Name
+	}
+
+	entry, err := db.GrantCredits(actor, r.PathValue("id"), req.Amount, req.Note)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "Customer not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to grant credits to %s: %v\n", r.PathValue("id"), err)
+		http.Error(w, "Failed to grant credits", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("AUDIT: %s granted %d credits to customer %s (%s)\n", actor.Name, req.Amount, entry.CustomerID, req.Note)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"entry":   entry,
+		"balance": entry.BalanceAfter,
+	})
+}
+
+// API: Admin Suspend a customer, blocking their API keys
+func handleSuspendCustomer(w http.ResponseWriter, r *http.Request) {
+	actor := actorFromContext(r)
+	reason, err := readReason(r)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if reason == "" {
+		http.Error(w, "Reason is required", http.StatusBadRequest)
+		return
+	}
+
+	customer, err := db.SuspendCustomer(actor, r.PathValue("id"), reason)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "Customer not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to suspend customer", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("AUDIT: %s suspended customer %s: %s\n", actor.Name, customer.ID, reason)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(customerResponse(customer))
+}
+
+// API: Admin Reinstate a suspended customer
+func handleReinstateCustomer(w http.ResponseWriter, r *http.Request) {
+	actor := actorFromContext(r)
+	reason, err := readReason(r)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	customer, err := db.ReinstateCustomer(actor, r.PathValue("id"), reason)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "Customer not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to reinstate customer", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("AUDIT: %s reinstated customer %s\n", actor.Name, customer.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(customerResponse(customer))
+}
+
+// API: Operator Ban a node; its live connection is dropped and its jobs go back to the
+// queue once the reconnect grace runs out
+func handleBanNode(w http.ResponseWriter, r *http.Request) {
+	actor := actorFromContext(r)
+	reason, err := readReason(r)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if reason == "" {
+		http.Error(w, "Reason is required", http.StatusBadRequest)
+		return
+	}
+
+	node, err := db.BanNode(actor, r.PathValue("id"), reason)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "Node not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to ban node", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("AUDIT: %s banned node %s: %s\n", actor.Name, node.ID, reason)
+
+	mu.RLock()
+	sess := providers[node.ID]
+	mu.RUnlock()
+	if sess != nil {
+		log.Printf("Disconnecting banned node %s\n", node.ID)
+		sess.Conn.Close()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"node_id":    node.ID,
+		"banned_at":  node.BannedAt,
+		"ban_reason": node.BanReason,
+	})
+}
+
+// The benchmark job: it squares 20M integers and prints a score inverse to the time taken
+var (
+	benchmarkImage = "python:3.9-alpine"
+	benchmarkCmd   = []string{"python", "-c", "import time; s=time.time(); [x**2 for x in range(20000000)]; print(int(10000/(time.time()-s)))"}
+)
+
+// API: Operator Queue a benchmark job; it is free, and its score goes to the node that
+// runs it
+func handleRunBenchmark(w http.ResponseWriter, r *http.Request) {
+	actor := actorFromContext(r)
+
+	job := db.Job{
+		ID:        uuid.New().String(),
+		Image:     benchmarkImage,
+		Cmd:       benchmarkCmd,
+		Status:    db.JobQueued,
+		Benchmark: true,
+	}
+	if err := db.SubmitJob(&job, 0); err != nil {
+		log.Printf("Failed to queue benchmark job: %v\n", err)
+		http.Error(w, "Failed to create job", http.StatusInternalServerError)
+		return
+	}
+	wakeDispatcher()
+	log.Printf("Benchmark job %s queued by %s\n", job.ID, actor.Name)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"job_id": job.ID,
+		"status": job.Status,
+	})
+}
+
+// API: Operator Unban a node
+func handleUnbanNode(w http.ResponseWriter, r *http.Request) {
+	actor := actorFromContext(r)
+	reason, err := readReason(r)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	node, err := db.UnbanNode(actor, r.PathValue("id"), reason)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "Node not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to unban node", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("AUDIT: %s unbanned node %s\n", actor.Name, node.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"node_id":   node.ID,
+		"banned_at": node.BannedAt,
+	})
+}
+
+// adminTokenResponse describes an admin token without its secret
+func adminTokenResponse(token *db.AdminToken) map[string]interface{} {
+	return map[string]interface{}{
+		"id":           token.ID,
+		"name":         token.Name,
+		"role":         token.Role,
+		"prefix":       token.Prefix,
+		"created_by":   token.CreatedBy,
+		"created_at":   token.CreatedAt,
+		"revoked_at":   token.RevokedAt,
+		"last_used_at": token.LastUsedAt,
+	}
+}
+
+// API: Admin List admin tokens
+func handleListAdminTokens(w http.ResponseWriter, r *http.Request) {
+	tokens, err := db.AdminTokens()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	out := make([]map[string]interface{}, 0, len(tokens))
+	for i := range tokens {
+		out = append(out, adminTokenResponse(&tokens[i]))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// API: Admin Issue an admin or operator token
+func handleCreateAdminToken(w http.ResponseWriter, r *http.Request) {
+	actor := actorFromContext(r)
+
+	var req struct {
+		Name string `json:"name"`
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+	if req.Role != db.RoleAdmin && req.Role != db.RoleOperator {
+		http.Error(w, "Role must be admin or operator", http.StatusBadRequest)
+		return
+	}
+
+	secret, err := generateAdminToken()
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	token, err := db.CreateAdminToken(actor, req.Name, req.Role, secret)
+	if err != nil {
+		http.Error(w, "Failed to create token", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("AUDIT: %s issued %s token %s (%s)\n", actor.Name, token.Role, token.ID, token.Name)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":       adminTokenResponse(token),
+		"admin_token": secret,
+	})
+}
+
+// API: Admin Revoke an admin token
+func handleRevokeAdminToken(w http.ResponseWriter, r *http.Request) {
+	actor := actorFromContext(r)
+
+	token, err := db.RevokeAdminToken(actor, r.PathValue("id"))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to revoke token", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("AUDIT: %s revoked %s token %s (%s)\n", actor.Name, token.Role, token.ID, token.Name)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(adminTokenResponse(token))
+}
+
+// API: Admin Get the most recent audit entries
+func handleGetAudit(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 {
+			http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	entries, err := db.AuditEntries(limit)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
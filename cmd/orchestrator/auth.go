@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/gridforce/core/internal/core/db"
+)
+
+// Roles a route can require. Customers authenticate with an API key in X-API-KEY, staff
+// (operators and admins) with an admin token in X-ADMIN-TOKEN. Admins may call every
+// operator route.
+const (
+	rolePublic   = "public"
+	roleCustomer = "customer"
+	roleOperator = db.RoleOperator
+	roleAdmin    = db.RoleAdmin
+)
+
+// route is an API endpoint with the role it requires; customer routes also name the API key
+// scope they need
+type route struct {
+	pattern string
+	role    string
+	scope   string
+	handler http.HandlerFunc
+}
+
+// registerRoutes serves each route behind the check of its role
+func registerRoutes(mux *http.ServeMux, routes []route) {
+	for _, rt := range routes {
+		mux.HandleFunc(rt.pattern, authorize(rt.role, rt.scope, rt.handler))
+	}
+}
+
+// authorize wraps a handler with the authentication its role requires
+func authorize(role, scope string, next http.HandlerFunc) http.HandlerFunc {
+	switch role {
+	case rolePublic:
+		return next
+	case roleCustomer:
+		return requireCustomer(scope, next)
+	case roleOperator, roleAdmin:
+		return requireStaff(role, next)
+	}
+	log.Fatalf("Route requires unknown role %q", role)
+	return nil
+}
+
+// bootstrapToken is the admin credential from ADMIN_TOKEN. It works without any token in
+// the database, so the first admin tokens can be issued with it.
+var bootstrapToken string
+
+// loadAdminConfig reads ADMIN_TOKEN from the environment
+func loadAdminConfig() {
+	bootstrapToken = os.Getenv("ADMIN_TOKEN")
+	if bootstrapToken == "" {
+		log.Println("Warning: ADMIN_TOKEN is not set, only admin tokens issued earlier are accepted")
+		return
+	}
+	if len(bootstrapToken) < 16 {
+		log.Fatal("Invalid ADMIN_TOKEN: must be at least 16 characters")
+	}
+}
+
+type contextKey string
+
+const (
+	customerContextKey contextKey = "customer"
+	apiKeyContextKey   contextKey = "api_key"
+	actorContextKey    contextKey = "actor"
+)
+
+// customerFromContext returns the customer attached by requireCustomer
+func customerFromContext(r *http.Request) *db.Customer {
+	customer, _ := r.Context().Value(customerContextKey).(*db.Customer)
+	return customer
+}
+
+// apiKeyFromContext returns the API key the customer authenticated with
+func apiKeyFromContext(r *http.Request) *db.APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey).(*db.APIKey)
+	return key
+}
+
+// actorFromContext returns the staff member attached by requireStaff
+func actorFromContext(r *http.Request) db.Actor {
+	actor, _ := r.Context().Value(actorContextKey).(db.Actor)
+	return actor
+}
+
+// lookupCustomer resolves the X-API-KEY header to a customer and the key they used
+func lookupCustomer(r *http.Request) (*db.Customer, *db.APIKey, int, string) {
+	apiKey := r.Header.Get("X-API-KEY")
+	if apiKey == "" {
+		return nil, nil, http.StatusUnauthorized, "Unauthorized: Validation Failed"
+	}
+
+	customer, key, err := db.AuthenticateAPIKey(apiKey)
+	switch {
+	case errors.Is(err, db.ErrAPIKeyRevoked):
+		return nil, nil, http.StatusUnauthorized, "Unauthorized: API Key Revoked"
+	case errors.Is(err, db.ErrAPIKeyExpired):
+		return nil, nil, http.StatusUnauthorized, "Unauthorized: API Key Expired"
+	case err != nil:
+		return nil, nil, http.StatusUnauthorized, "Unauthorized: Invalid API Key"
+	}
+	if customer.SuspendedAt != nil {
+		return nil, nil, http.StatusForbidden, "Forbidden: Account Suspended"
+	}
+	return customer, key, http.StatusOK, ""
+}
+
+// requireCustomer authenticates the caller by API key and checks that the key grants scope;
+// an empty scope admits any valid key. Jobs are paid for by metered usage, not per request.
+func requireCustomer(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		customer, key, status, msg := lookupCustomer(r)
+		if customer == nil {
+			http.Error(w, msg, status)
+			return
+		}
+		if scope != "" && !key.HasScope(scope) {
+			http.Error(w, "Forbidden: API key lacks scope "+scope, http.StatusForbidden)
+			return
+		}
+		ctx := context.WithValue(r.Context(), customerContextKey, customer)
+		ctx = context.WithValue(ctx, apiKeyContextKey, key)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// lookupActor resolves the X-ADMIN-TOKEN header to a staff member
+func lookupActor(r *http.Request) (db.Actor, bool) {
+	token := r.Header.Get("X-ADMIN-TOKEN")
+	if token == "" {
+		return db.Actor{}, false
+	}
+	if bootstrapToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(bootstrapToken)) == 1 {
+		return db.Actor{ID: "bootstrap", Name: "bootstrap", Role: db.RoleAdmin}, true
+	}
+	t, err := db.AuthenticateAdminToken(token)
+	if err != nil {
+		return db.Actor{}, false
+	}
+	return db.Actor{ID: t.ID, Name: t.Name, Role: t.Role}, true
+}
+
+// requireStaff admits operators and admins holding at least role
+func requireStaff(role string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor, ok := lookupActor(r)
+		if !ok {
+			log.Printf("Rejected staff request %s %s from %s\n", r.Method, r.URL.Path, r.RemoteAddr)
+			http.Error(w, "Unauthorized: Invalid Admin Token", http.StatusUnauthorized)
+			return
+		}
+		if role == roleAdmin && actor.Role != db.RoleAdmin {
+			log.Printf("Operator %s denied %s %s\n", actor.Name, r.Method, r.URL.Path)
+			http.Error(w, "Forbidden: requires role "+role, http.StatusForbidden)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), actorContextKey, actor)))
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gridforce/core/internal/core/billing"
+	"github.com/gridforce/core/internal/core/db"
+	"github.com/gridforce/core/internal/core/pricing"
+	"github.com/gridforce/core/internal/core/scheduler"
+	"github.com/gridforce/core/pkg/protocol"
+)
+
+// Memory assumed for jobs without a memory limit when sizing their hold
+const defaultReserveMemoryGB = 1.0
+
+var (
+	// Prices jobs at their provider's rates plus the platform fee. The default rates, in
+	// credits per hour of each metered unit, apply to providers that advertise none.
+	pricer = pricing.Engine{
+		Default:    billing.Tariff{CoreHour: 60, MemoryGBHour: 6, WallHour: 0},
+		FeePercent: 10,
+	}
+	// Run time held for jobs without a timeout
+	reservationWindow = time.Hour
+)
+
+// loadBillingConfig reads RATE_CORE_HOUR, RATE_GB_HOUR, RATE_WALL_HOUR (credits),
+// PLATFORM_FEE_PERCENT and RESERVATION_WINDOW (seconds) from the environment
+func loadBillingConfig() {
+	rates := []struct {
+		env  string
+		rate *float64
+	}{
+		{"RATE_CORE_HOUR", &pricer.Default.CoreHour},
+		{"RATE_GB_HOUR", &pricer.Default.MemoryGBHour},
+		{"RATE_WALL_HOUR", &pricer.Default.WallHour},
+		{"PLATFORM_FEE_PERCENT", &pricer.FeePercent},
+	}
+	for _, r := range rates {
+		if v := os.Getenv(r.env); v != "" {
+			rate, err := strconv.ParseFloat(v, 64)
+			if err != nil || rate < 0 {
+				log.Fatalf("Invalid %s: %s", r.env, v)
+			}
+			*r.rate = rate
+		}
+	}
+	if v := os.Getenv("RESERVATION_WINDOW"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err != nil || secs < 1 {
+			log.Fatal("Invalid RESERVATION_WINDOW: ", v)
+		}
+		reservationWindow = time.Duration(secs) * time.Second
+	}
+}
+
+// jobMemoryGB returns the memory a job is billed for when its usage is not metered
+func jobMemoryGB(job *db.Job) float64 {
+	if job.MemoryMB > 0 {
+		return float64(job.MemoryMB) / 1024
+	}
+	return defaultReserveMemoryGB
+}
+
+// jobAllocation is the most a job can use: its full allocation for its timeout, or for
+// reservationWindow if it has none
+func jobAllocation(job *db.Job) billing.Usage {
+	wall := reservationWindow
+	if job.TimeoutSeconds > 0 {
+		wall = time.Duration(job.TimeoutSeconds) * time.Second
+	}
+	return billing.Allocation(float64(jobCores(job)), jobMemoryGB(job), wall)
+}
+
+// referencePrice is the most a job can cost on a provider charging the default rates. It
+// caps the price of jobs submitted without a max price of their own.
+func referencePrice(job *db.Job) int64 {
+	return pricer.Quote(pricer.Default, jobAllocation(job)).Total
+}
+
+// providerRates converts the prices a provider advertised
+func providerRates(p protocol.Prices) billing.Tariff {
+	return billing.Tariff{CoreHour: p.CoreHour, MemoryGBHour: p.MemoryGBHour, WallHour: p.WallHour}
+}
+
+// priceCandidates returns the candidates with the price of a job on each of them
+func priceCandidates(job *db.Job, candidates []scheduler.Candidate) []scheduler.Candidate {
+	allocation := jobAllocation(job)
+	priced := slices.Clone(candidates)
+	for i := range priced {
+		priced[i].Price = pricer.Quote(priced[i].Rates, allocation).Total
+	}
+	return priced
+}
+
+// jobQuote prices a job's usage at the rates of its provider, within the job's max price
+func jobQuote(job *db.Job, usage billing.Usage) pricing.Quote {
+	q := pricer.Quote(job.Rates, usage)
+	if job.MaxPrice > 0 {
+		q = pricer.Cap(q, job.MaxPrice)
+	}
+	return q
+}
+
+// meteredUsage returns the usage the provider reported for a job. Providers that do not
+// meter are billed for the job's allocation over the time its container ran.
+func meteredUsage(job *db.Job, payload *protocol.JobResultPayload) billing.Usage {
+	if u := payload.Usage; u != nil {
+		return billing.Usage{CPUSeconds: u.CPUSeconds, MemoryGBSeconds: u.MemoryGBSeconds, WallSeconds: u.WallSeconds}
+	}
+	if payload.StartedAt.IsZero() || payload.FinishedAt.Before(payload.StartedAt) {
+		return billing.Usage{}
+	}
+	return billing.Allocation(float64(jobCores(job)), jobMemoryGB(job), payload.FinishedAt.Sub(payload.StartedAt))
+}
+
+// customerCaused reports whether a job ended the way its customer is billed for: it
+// succeeded, or failed through its own command, memory limit or timeout. Only a timeout the
+// provider reported for the job's own wall clock counts; a TIMED_OUT status alone does not.
+// Limits count only if the customer set them: a limit the provider's policy filled in is
+// the provider's. Every other failure (pulls, Docker errors, policy mismatches, no,
+// stalled or lost providers) is the platform's.
+func customerCaused(job *db.Job, status, failureReason string) bool {
+	if status == db.JobSucceeded {
+		return true
+	}
+	switch failureReason {
+	case protocol.FailureExitCode:
+		return true
+	case protocol.FailureOOMKilled:
+		return job.MemoryMB > 0
+	case protocol.FailureTimeout:
+		return job.TimeoutSeconds > 0
+	}
+	return false
+}
+
+// settleJob releases a finished job's hold and returns how the charge splits into the
+// provider's reward and the platform fee. Usage is charged only if the customer caused the
+// outcome; platform failures and benchmarks cost nothing.
+func settleJob(job *db.Job, status, failureReason string, usage billing.Usage) pricing.Quote {
+	var q pricing.Quote
+	reason := "platform failure " + failureReason
+	if job.Benchmark {
+		reason = "benchmark"
+	} else if customerCaused(job, status, failureReason) {
+		q = jobQuote(job, usage)
+		reason = "job " + strings.ToLower(status)
+		if failureReason != "" {
+			reason += " (" + failureReason + ")"
+		}
+	}
+
+	charged, err := db.SettleJob(job.ID, q.Total, reason)
+	if err != nil {
+		log.Printf("Failed to settle job %s: %v\n", job.ID, err)
+		return pricing.Quote{}
+	}
+	// The charge is capped at what the customer's balance could cover
+	q = pricer.Cap(q, charged)
+	log.Printf("Job %s settled, %s: %d credits charged (%.1f core-s, %.1f GB-s, %.1f s), %d held\n", job.ID, reason, charged, usage.CPUSeconds, usage.MemoryGBSeconds, usage.WallSeconds, job.Reserved)
+	return q
+}
+
+// rewardProvider pays a settled job's provider its share of the charge, in node tokens and
+// on chain
+func rewardProvider(job *db.Job, q pricing.Quote) {
+	if job.NodeID == "" || q.Total == 0 {
+		return
+	}
+	node, err := db.RecordReward(job.ID, job.NodeID, q.Reward, q.Fee)
+	if err != nil {
+		log.Printf("Failed to reward %s for job %s: %v\n", job.NodeID, job.ID, err)
+		return
+	}
+	if node == nil {
+		return // rewarded before
+	}
+
+	mu.Lock()
+	if sess, ok := providers[node.ID]; ok {
+		sess.Tokens = node.Tokens
+	}
+	mu.Unlock()
+	log.Printf("Job %s | Node Rewarded: %s (+%d Tokens, %d platform fee)\n", job.ID, node.ID, q.Reward, q.Fee)
+	if q.Reward == 0 {
+		return
+	}
+
+	// Mint Tokens on Blockchain
+	walletAddr := node.WalletAddress
+	if chainClient != nil && walletAddr != "" && walletAddr != "0x000000000000000000000000000000000000dead" {
+		tx, err := chainClient.MintToken(walletAddr, q.Reward)
+		if err != nil {
+			log.Printf("Blockchain Error: Failed to mint tokens: %v\n", err)
+		} else {
+			log.Printf("Blockchain Tx Sent: %s | Minted %d GRID to %s\n", tx, q.Reward, walletAddr)
+		}
+	} else {
+		log.Println("Skipping Blockchain Mint: Client not init or invalid wallet")
+	}
+}
+
+// settleUnsettledJobs settles jobs that finished without being settled, e.g. because the
+// orchestrator stopped in between. Their usage is read back from the job.
+func settleUnsettledJobs() {
+	jobs, err := db.UnsettledJobs()
+	if err != nil {
+		log.Printf("Warning: Failed to load unsettled jobs: %v\n", err)
+		return
+	}
+	for i := range jobs {
+		job := &jobs[i]
+		if job.Status == db.JobCancelled {
+			if _, err := db.SettleJob(job.ID, 0, "cancelled by customer"); err != nil {
+				log.Printf("Failed to settle job %s: %v\n", job.ID, err)
+			}
+			continue
+		}
+		usage := billing.Usage{CPUSeconds: job.CPUSeconds, MemoryGBSeconds: job.MemoryGBSeconds, WallSeconds: job.WallSeconds}
+		rewardProvider(job, settleJob(job, job.Status, job.FailureReason, usage))
+	}
+}
+
+// cancelCharge bills a cancelled job for its allocation over the time it ran; jobs that
+// never started are not charged
+func cancelCharge(job *db.Job) int64 {
+	if job.Status != db.JobRunning || job.StartedAt == nil {
+		return 0
+	}
+	return jobQuote(job, billing.Allocation(float64(jobCores(job)), jobMemoryGB(job), time.Since(*job.StartedAt))).Total
+}
+
+// API: Get the caller's balance and recent ledger entries
+func handleGetLedger(w http.ResponseWriter, r *http.Request) {
+	customer := customerFromContext(r)
+
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 500 {
+			http.Error(w, "limit must be between 1 and 500", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	entries, err := db.LedgerEntries(customer.ID, limit)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"balance": customer.Credits,
+		"entries": entries,
+	})
+}
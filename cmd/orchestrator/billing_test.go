@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gridforce/core/internal/core/db"
+	"github.com/gridforce/core/pkg/protocol"
+)
+
+func TestCustomerCaused(t *testing.T) {
+	limited := &db.Job{TimeoutSeconds: 60, MemoryMB: 512}
+	unlimited := &db.Job{}
+	tests := []struct {
+		name                  string
+		job                   *db.Job
+		status, failureReason string
+		want                  bool
+	}{
+		{"succeeded", limited, db.JobSucceeded, "", true},
+		{"non-zero exit", limited, db.JobFailed, protocol.FailureExitCode, true},
+		{"own memory limit", limited, db.JobFailed, protocol.FailureOOMKilled, true},
+		{"own timeout", limited, db.JobTimedOut, protocol.FailureTimeout, true},
+
+		// Limits the provider's policy filled in are the provider's
+		{"succeeded without limits", unlimited, db.JobSucceeded, "", true},
+		{"non-zero exit without limits", unlimited, db.JobFailed, protocol.FailureExitCode, true},
+		{"provider memory cap", unlimited, db.JobFailed, protocol.FailureOOMKilled, false},
+		{"provider timeout cap", unlimited, db.JobTimedOut, protocol.FailureTimeout, false},
+		{"provider memory cap with own timeout", &db.Job{TimeoutSeconds: 60}, db.JobFailed, protocol.FailureOOMKilled, false},
+		{"provider timeout cap with own memory limit", &db.Job{MemoryMB: 512}, db.JobTimedOut, protocol.FailureTimeout, false},
+
+		// Timeouts not on the job's own wall clock are the platform's
+		{"stalled", limited, db.JobTimedOut, "", false},
+		{"timed out on a lost provider", limited, db.JobTimedOut, protocol.FailureProviderLost, false},
+
+		{"error", limited, db.JobFailed, protocol.FailureError, false},
+		{"policy", limited, db.JobFailed, protocol.FailurePolicy, false},
+		{"no provider", limited, db.JobFailed, protocol.FailureNoProvider, false},
+		{"provider lost", limited, db.JobFailed, protocol.FailureProviderLost, false},
+		{"cancelled", limited, db.JobCancelled, protocol.FailureCancelled, false},
+	}
+	for _, tt := range tests {
+		if got := customerCaused(tt.job, tt.status, tt.failureReason); got != tt.want {
+			t.Errorf("%s: customerCaused(%s, %q) = %t, want %t", tt.name, tt.status, tt.failureReason, got, tt.want)
+		}
+	}
+}
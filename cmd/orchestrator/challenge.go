@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/gridforce/core/internal/core/blockchain"
+	"github.com/gridforce/core/pkg/protocol"
+)
+
+// newNonce returns a random single-use challenge for a connecting provider
+func newNonce() (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+// verifyProviderAuth checks that an AUTH message is signed by both the device and the wallet
+// it claims and returns that wallet's checksummed address
+func verifyProviderAuth(nonce string, auth protocol.AuthPayload) (string, error) {
+	if nonce == "" {
+		return "", errors.New("no outstanding challenge")
+	}
+	if err := verifyDevice(nonce, auth); err != nil {
+		return "", err
+	}
+	if !common.IsHexAddress(auth.WalletAddress) {
+		return "", fmt.Errorf("invalid wallet address %q", auth.WalletAddress)
+	}
+
+	sig, err := hexutil.Decode(auth.Signature)
+	if err != nil {
+		return "", fmt.Errorf("invalid signature encoding: %v", err)
+	}
+	signer, err := blockchain.RecoverPersonal(protocol.ChallengeMessage(nonce), sig)
+	if err != nil {
+		return "", err
+	}
+
+	claimed := common.HexToAddress(auth.WalletAddress)
+	if signer != claimed {
+		return "", fmt.Errorf("signature is from %s, not %s", signer.Hex(), claimed.Hex())
+	}
+	return claimed.Hex(), nil
+}
+
+// verifyDevice checks the challenge signature made with the device key the device ID encodes
+func verifyDevice(nonce string, auth protocol.AuthPayload) error {
+	pub, err := hex.DecodeString(auth.DeviceID)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid device ID %q", auth.DeviceID)
+	}
+	sig, err := hex.DecodeString(auth.DeviceSignature)
+	if err != nil {
+		return fmt.Errorf("invalid device signature encoding: %v", err)
+	}
+	if !ed25519.Verify(ed25519.PublicKey(pub), []byte(protocol.ChallengeMessage(nonce)), sig) {
+		return errors.New("device signature does not match device ID")
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gridforce/core/internal/core/billing"
+	"github.com/gridforce/core/internal/core/db"
+	"github.com/gridforce/core/internal/core/scheduler"
+	"github.com/gridforce/core/pkg/protocol"
+)
+
+// How often the dispatcher polls the queue when nothing wakes it up
+const dispatchInterval = 2 * time.Second
+
+var (
+	// How long a job may wait in the queue before it fails for lack of a provider
+	queueTimeout = time.Hour
+	// Times a job's provider may go away before the job fails instead of being requeued
+	maxNodeLosses = 3
+)
+
+// loadDispatchConfig reads QUEUE_TIMEOUT (seconds) and MAX_NODE_LOSSES from the environment
+func loadDispatchConfig() {
+	if v := os.Getenv("QUEUE_TIMEOUT"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err != nil || secs < 1 {
+			log.Fatal("Invalid QUEUE_TIMEOUT: ", v)
+		}
+		queueTimeout = time.Duration(secs) * time.Second
+	}
+	if v := os.Getenv("MAX_NODE_LOSSES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatal("Invalid MAX_NODE_LOSSES: ", v)
+		}
+		maxNodeLosses = n
+	}
+}
+
+var dispatchSignal = make(chan struct{}, 1)
+
+// wakeDispatcher nudges the dispatcher loop without blocking the caller
+func wakeDispatcher() {
+	select {
+	case dispatchSignal <- struct{}{}:
+	default:
+	}
+}
+
+// runDispatcher assigns queued jobs to idle providers until either runs out, then waits
+// for a new submission, a freed provider or the next poll tick
+func runDispatcher() {
+	ticker := time.NewTicker(dispatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			declines.prune()
+		case <-dispatchSignal:
+		}
+		failStaleJobs()
+		for dispatchNext() {
+		}
+	}
+}
+
+// dispatchNext places a single queued job and reports whether it is worth trying again
+func dispatchNext() bool {
+	candidates := providerCandidates()
+	job, err := db.AssignNextJob(func(job *db.Job) (string, billing.Tariff) {
+		chosen, err := sched.Select(jobRequirements(job), priceCandidates(job, candidates))
+		if err != nil {
+			return "", billing.Tariff{}
+		}
+		return chosen.ID, pricer.Rates(chosen.Rates)
+	})
+	if errors.Is(err, db.ErrNoJobAssigned) {
+		return false
+	}
+	if err != nil {
+		log.Printf("Dispatcher: failed to assign job: %v\n", err)
+		return false
+	}
+
+	offer, err := protocol.Encode(protocol.JobOfferPayload{
+		JobID: job.ID,
+		Image: job.Image,
+		Cmd:   job.Cmd,
+		Resources: protocol.ResourceLimits{
+			CPUs:           job.CPUs,
+			MemoryMB:       job.MemoryMB,
+			PidsLimit:      job.PidsLimit,
+			ShmSizeMB:      job.ShmSizeMB,
+			TimeoutSeconds: job.TimeoutSeconds,
+		},
+		Sandbox: protocol.SandboxSpec{
+			Network:        job.NeedsNetwork,
+			WritableRootfs: job.NeedsWritableRootfs,
+			RunAsRoot:      job.NeedsRoot,
+		},
+	})
+	if err != nil {
+		log.Printf("Dispatcher: failed to encode job offer for %s: %v\n", job.ID, err)
+		db.TransitionJob(job.ID, db.JobFailed, map[string]interface{}{"error": err.Error(), "failure_reason": protocol.FailureError})
+		settleJob(job, db.JobFailed, protocol.FailureError, billing.Usage{})
+		return true
+	}
+
+	mu.Lock()
+	sess, ok := providers[job.NodeID]
+	// The node may have reconnected since it was picked, on a session not yet ONLINE
+	ok = ok && sess.Status == "ONLINE"
+	if ok {
+		a := &assignment{Cores: jobCores(job), LogSeqBase: job.LogSeqBase, OfferID: offer.ID}
+		// Providers that negotiated offers must accept or reject in time; older ones just run the job
+		if sess.supports(protocol.FeatureOffers) {
+			jobID := job.ID
+			a.OfferTimer = time.AfterFunc(offerTimeout, func() { expireOffer(sess, jobID, offer.ID) })
+		}
+		sess.Jobs[job.ID] = a
+	}
+	mu.Unlock()
+
+	if !ok {
+		log.Printf("Dispatcher: provider %s left before job %s was offered, requeueing\n", job.NodeID, job.ID)
+		db.TransitionJob(job.ID, db.JobQueued, nil)
+		return true
+	}
+
+	if err := sess.write(offer); err != nil {
+		log.Printf("Dispatcher: failed to send job offer for %s to %s: %v\n", job.ID, job.NodeID, err)
+		releaseSlot(sess, job.ID)
+		db.TransitionJob(job.ID, db.JobQueued, nil)
+		return false
+	}
+
+	log.Printf("Job %s dispatched to %s\n", job.ID, job.NodeID)
+	return true
+}
+
+// failStaleJobs fails queued jobs no provider took in time or whose providers kept going
+// away, releasing their holds
+func failStaleJobs() {
+	failed, err := db.FailStaleJobs(queueTimeout, maxNodeLosses, protocol.FailureNoProvider, protocol.FailureProviderLost)
+	if err != nil {
+		log.Printf("Dispatcher: failed to expire stale jobs: %v\n", err)
+		return
+	}
+	for i := range failed {
+		job := &failed[i]
+		log.Printf("Job %s failed (%s): %s\n", job.ID, job.FailureReason, job.Error)
+		jobLogs.close(job.ID)
+		settleJob(job, db.JobFailed, job.FailureReason, billing.Usage{})
+	}
+}
+
+// providerCandidates snapshots the authenticated providers for the scheduler
+func providerCandidates() []scheduler.Candidate {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	var candidates []scheduler.Candidate
+	for addr, sess := range providers {
+		if sess.Status != "ONLINE" {
+			continue
+		}
+		candidates = append(candidates, scheduler.Candidate{
+			ID:             addr,
+			OS:             sess.OS,
+			Arch:           sess.Arch,
+			CpuCores:       sess.CpuCores,
+			UsedCores:      sess.usedCores(),
+			BenchmarkScore: sess.BenchmarkScore,
+			ActiveJobs:     sess.activeJobs(),
+			Slots:          sess.Slots,
+
+			AllowNetwork:        sess.Sandbox.Network,
+			AllowWritableRootfs: sess.Sandbox.WritableRootfs,
+			AllowRoot:           sess.Sandbox.RunAsRoot,
+
+			Rates: providerRates(sess.Prices),
+		})
+	}
+	return candidates
+}
+
+// jobRequirements converts a job's stored placement requirements for the scheduler; nodes
+// that recently declined the job are excluded, as are nodes where it exceeds its max price
+func jobRequirements(job *db.Job) scheduler.Requirements {
+	return scheduler.Requirements{
+		MinCores:          jobCores(job),
+		Platform:          job.Platform,
+		MinBenchmarkScore: job.MinBenchmarkScore,
+
+		Network:        job.NeedsNetwork,
+		WritableRootfs: job.NeedsWritableRootfs,
+		RunAsRoot:      job.NeedsRoot,
+
+		Exclude:  declines.excluded(job.ID),
+		MaxPrice: job.MaxPrice,
+	}
+}
+
+// jobCores returns the number of cores a job occupies on its provider: the larger of its
+// placement requirement and its CPU limit, and at least one
+func jobCores(job *db.Job) int {
+	cores := int(math.Ceil(job.CPUs))
+	if job.MinCores > cores {
+		cores = job.MinCores
+	}
+	if cores < 1 {
+		return 1
+	}
+	return cores
+}
+
+// releaseSlot marks one of a provider's jobs as finished so it can take new work
+func releaseSlot(sess *ProviderSession, jobID string) {
+	mu.Lock()
+	delete(sess.Jobs, jobID)
+	mu.Unlock()
+	wakeDispatcher()
+}
+
+// resultUpdates maps a provider's JOB_RESULT and the job's metered usage onto job columns
+func resultUpdates(payload *protocol.JobResultPayload, usage billing.Usage) map[string]interface{} {
+	updates := map[string]interface{}{
+		"result":           payload.Stdout,
+		"stderr":           payload.Stderr,
+		"stdout_truncated": payload.StdoutTruncated,
+		"stderr_truncated": payload.StderrTruncated,
+		"exit_code":        payload.ExitCode,
+		"image_digest":     payload.ImageDigest,
+		"error":            payload.Error,
+		"failure_reason":   payload.FailureReason,
+
+		"cpu_seconds":       usage.CPUSeconds,
+		"memory_gb_seconds": usage.MemoryGBSeconds,
+		"wall_seconds":      usage.WallSeconds,
+	}
+	// Only record the stages the provider actually reached
+	if !payload.PulledAt.IsZero() {
+		updates["pulled_at"] = payload.PulledAt
+	}
+	if !payload.StartedAt.IsZero() {
+		updates["container_started_at"] = payload.StartedAt
+	}
+	if !payload.FinishedAt.IsZero() {
+		updates["container_finished_at"] = payload.FinishedAt
+	}
+	return updates
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/gridforce/core/pkg/protocol"
+)
+
+var (
+	// Largest message read from a provider; larger ones close the connection. Providers
+	// that negotiated chunks are told the limit and send large outputs as binary chunks.
+	maxMessageSize int64 = 4 << 20
+	// Most chunked output held per provider session while waiting for its JOB_RESULT
+	maxBlobBuffer int64 = 16 << 20
+)
+
+// loadFramingConfig reads MAX_MESSAGE_SIZE and MAX_BLOB_BUFFER (bytes) from the environment
+func loadFramingConfig() {
+	if v := os.Getenv("MAX_MESSAGE_SIZE"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 64<<10 {
+			log.Fatal("Invalid MAX_MESSAGE_SIZE (at least 65536): ", v)
+		}
+		maxMessageSize = n
+	}
+	if v := os.Getenv("MAX_BLOB_BUFFER"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			log.Fatal("Invalid MAX_BLOB_BUFFER: ", v)
+		}
+		maxBlobBuffer = n
+	}
+}
+
+// handleChunk stores a binary frame until the message referring to its blob arrives
+func handleChunk(sess *ProviderSession, frame []byte) {
+	var chunk protocol.Chunk
+	if err := chunk.UnmarshalBinary(frame); err != nil {
+		log.Printf("Dropping binary frame from %s: %v\n", sess.DeviceID, err)
+		return
+	}
+	if err := sess.blobs.Add(chunk); err != nil {
+		log.Printf("Dropping chunk from %s: %v\n", sess.DeviceID, err)
+	}
+}
+
+// resolveBlobs replaces the blob references of a result with the outputs they carried.
+// Outputs cut short by the blob buffer are marked truncated.
+func resolveBlobs(sess *ProviderSession, payload *protocol.JobResultPayload) error {
+	if payload.StdoutBlob != "" {
+		data, truncated, err := sess.blobs.Take(payload.StdoutBlob)
+		if err != nil {
+			return err
+		}
+		payload.Stdout = string(data)
+		payload.StdoutTruncated = payload.StdoutTruncated || truncated
+		payload.StdoutBlob = ""
+	}
+	if payload.StderrBlob != "" {
+		data, truncated, err := sess.blobs.Take(payload.StderrBlob)
+		if err != nil {
+			return err
+		}
+		payload.Stderr = string(data)
+		payload.StderrTruncated = payload.StderrTruncated || truncated
+		payload.StderrBlob = ""
+	}
+	return nil
+}
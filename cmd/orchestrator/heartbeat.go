@@ -0,0 +1,130 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/gridforce/core/internal/core/db"
+	"github.com/gridforce/core/pkg/protocol"
+)
+
+var (
+	// Expected interval between provider heartbeats; pings are sent at the same rate
+	heartbeatInterval = 10 * time.Second
+	// Missed intervals after which a provider is considered gone and marked OFFLINE
+	heartbeatMissLimit = 3
+	// How long a disconnected provider's jobs wait for it to reconnect before being requeued
+	reconnectGrace = 60 * time.Second
+
+	// Requeue timers of disconnected nodes, by node ID
+	pendingRequeues   = make(map[string]*time.Timer)
+	pendingRequeuesMu sync.Mutex
+)
+
+// loadHeartbeatConfig reads HEARTBEAT_INTERVAL (seconds), HEARTBEAT_MISS_LIMIT and
+// RECONNECT_GRACE (seconds) from the environment
+func loadHeartbeatConfig() {
+	if v := os.Getenv("HEARTBEAT_INTERVAL"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err != nil || secs < 1 {
+			log.Fatal("Invalid HEARTBEAT_INTERVAL: ", v)
+		}
+		heartbeatInterval = time.Duration(secs) * time.Second
+	}
+	if v := os.Getenv("HEARTBEAT_MISS_LIMIT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatal("Invalid HEARTBEAT_MISS_LIMIT: ", v)
+		}
+		heartbeatMissLimit = n
+	}
+	if v := os.Getenv("RECONNECT_GRACE"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err != nil || secs < 0 {
+			log.Fatal("Invalid RECONNECT_GRACE: ", v)
+		}
+		reconnectGrace = time.Duration(secs) * time.Second
+	}
+}
+
+// readTimeout is how long a connection may stay silent (no message, no pong) before it is dropped
+func readTimeout() time.Duration {
+	return heartbeatInterval * time.Duration(heartbeatMissLimit)
+}
+
+// markAlive records activity from a provider and pushes back its read deadline
+func markAlive(conn *websocket.Conn, sess *ProviderSession) {
+	now := time.Now()
+	conn.SetReadDeadline(now.Add(readTimeout()))
+	mu.Lock()
+	sess.LastSeen = now
+	mu.Unlock()
+}
+
+// handleHeartbeat stores the load metrics a provider reports
+func handleHeartbeat(nodeID string, sess *ProviderSession, hb protocol.HeartbeatPayload) {
+	mu.Lock()
+	if hb.Slots > 0 {
+		sess.Slots = hb.Slots
+		sess.FreeSlots = hb.FreeSlots
+	}
+	sess.Load1 = hb.Load1
+	sess.MemUsedPercent = hb.MemUsedPercent
+	mu.Unlock()
+
+	db.DB.Model(&db.Node{}).Where("id = ?", nodeID).Update("last_seen", time.Now())
+	wakeDispatcher()
+}
+
+// scheduleRequeue gives a disconnected node reconnectGrace to come back before the jobs it
+// had in flight are requeued for other nodes
+func scheduleRequeue(nodeID string, inFlight []string) {
+	pendingRequeuesMu.Lock()
+	defer pendingRequeuesMu.Unlock()
+	if t, ok := pendingRequeues[nodeID]; ok {
+		t.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(reconnectGrace, func() {
+		// Held while requeueing so a reconnect cannot resume jobs that are being requeued.
+		// mu is taken first, as a reconnect does when it cancels the requeue.
+		mu.RLock()
+		pendingRequeuesMu.Lock()
+		defer pendingRequeuesMu.Unlock()
+		_, live := providers[nodeID]
+		mu.RUnlock()
+		if pendingRequeues[nodeID] != timer {
+			return
+		}
+		delete(pendingRequeues, nodeID)
+		// The node came back on a new session, which resumed its jobs
+		if live {
+			return
+		}
+
+		if n, err := db.RequeueNodeJobs(nodeID); err != nil {
+			log.Printf("Failed to requeue in-flight jobs for %s: %v\n", nodeID, err)
+		} else if n > 0 {
+			log.Printf("Node %s did not reconnect, requeued %d in-flight job(s)\n", nodeID, n)
+			wakeDispatcher()
+		}
+		for _, jobID := range inFlight {
+			jobLogs.close(jobID)
+		}
+	})
+	pendingRequeues[nodeID] = timer
+}
+
+// cancelRequeue stops the pending requeue of a node that reconnected. Callers hold mu.
+func cancelRequeue(nodeID string) {
+	pendingRequeuesMu.Lock()
+	defer pendingRequeuesMu.Unlock()
+	if t, ok := pendingRequeues[nodeID]; ok {
+		t.Stop()
+		delete(pendingRequeues, nodeID)
+	}
+}
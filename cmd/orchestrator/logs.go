@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gridforce/core/internal/core/db"
+	"github.com/gridforce/core/pkg/protocol"
+)
+
+// How often idle log streams get a keepalive and re-check the job's state
+const logKeepaliveInterval = 15 * time.Second
+
+// Buffered chunks per subscriber before it is considered too slow and disconnected
+const logSubscriberBuffer = 256
+
+// logHub fans live log chunks out to every reader of a job's log stream
+type logHub struct {
+	mu   sync.Mutex
+	subs map[string]map[chan protocol.JobLogPayload]struct{}
+}
+
+var jobLogs = &logHub{subs: make(map[string]map[chan protocol.JobLogPayload]struct{})}
+
+// subscribe registers a reader for a job's chunks
+func (h *logHub) subscribe(jobID string) chan protocol.JobLogPayload {
+	ch := make(chan protocol.JobLogPayload, logSubscriberBuffer)
+	h.mu.Lock()
+	if h.subs[jobID] == nil {
+		h.subs[jobID] = make(map[chan protocol.JobLogPayload]struct{})
+	}
+	h.subs[jobID][ch] = struct{}{}
+	h.mu.Unlock()
+	return ch
+}
+
+// unsubscribe removes a reader; it is safe to call after the hub dropped it
+func (h *logHub) unsubscribe(jobID string, ch chan protocol.JobLogPayload) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[jobID][ch]; ok {
+		delete(h.subs[jobID], ch)
+		close(ch)
+	}
+	if len(h.subs[jobID]) == 0 {
+		delete(h.subs, jobID)
+	}
+}
+
+// publish delivers a chunk to a job's readers. Readers that cannot keep up are dropped;
+// they resume from the stored chunks when they reconnect.
+func (h *logHub) publish(chunk protocol.JobLogPayload) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[chunk.JobID] {
+		select {
+		case ch <- chunk:
+		default:
+			delete(h.subs[chunk.JobID], ch)
+			close(ch)
+		}
+	}
+}
+
+// close disconnects every reader of a job, used once the job has finished
+func (h *logHub) close(jobID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[jobID] {
+		close(ch)
+	}
+	delete(h.subs, jobID)
+}
+
+// handleJobLog stores a chunk reported by the provider the job is assigned to and fans it out
+func handleJobLog(sess *ProviderSession, chunk protocol.JobLogPayload) {
+	mu.RLock()
+	a := sess.Jobs[chunk.JobID]
+	mu.RUnlock()
+	if a == nil {
+		log.Printf("Log chunk for job %s from %s dropped: job not assigned to it\n", chunk.JobID, sess.DeviceID)
+		return
+	}
+
+	// Continue the sequence of earlier attempts of the same job
+	chunk.Seq += a.LogSeqBase
+
+	stored, err := db.AppendJobLog(&db.JobLog{
+		JobID:  chunk.JobID,
+		Seq:    chunk.Seq,
+		Stream: chunk.Stream,
+		Data:   chunk.Data,
+	})
+	if err != nil {
+		log.Printf("Failed to store log chunk %d for job %s: %v\n", chunk.Seq, chunk.JobID, err)
+		return
+	}
+	if stored {
+		jobLogs.publish(chunk)
+	}
+}
+
+// API: Stream Job Logs (owner only) as Server-Sent Events.
+// Each event carries the chunk's sequence number as its ID; clients resume by sending
+// Last-Event-ID (or ?after=<seq>) when they reconnect. The stream ends with an "end" event
+// once the job reaches a terminal state.
+func handleJobLogs(w http.ResponseWriter, r *http.Request) {
+	customer := customerFromContext(r)
+
+	var job db.Job
+	if err := db.DB.First(&job, "id = ? AND customer_id = ?", r.PathValue("id"), customer.ID).Error; err != nil {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	var after int64
+	resume := r.Header.Get("Last-Event-ID")
+	if resume == "" {
+		resume = r.URL.Query().Get("after")
+	}
+	if resume != "" {
+		n, err := strconv.ParseInt(resume, 10, 64)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid resume position", http.StatusBadRequest)
+			return
+		}
+		after = n
+	}
+
+	// Subscribe before replaying so no chunk falls between the two
+	live := jobLogs.subscribe(job.ID)
+	defer jobLogs.unsubscribe(job.ID, live)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	writeChunk := func(chunk protocol.JobLogPayload) {
+		data, _ := json.Marshal(chunk)
+		fmt.Fprintf(w, "id: %d\nevent: log\ndata: %s\n\n", chunk.Seq, data)
+		after = chunk.Seq
+	}
+
+	// ended sends the closing event if the job is finished
+	ended := func() bool {
+		var current db.Job
+		if err := db.DB.Select("status").First(&current, "id = ?", job.ID).Error; err != nil || !db.IsTerminal(current.Status) {
+			return false
+		}
+		// Pick up chunks that were stored after the last replay
+		replay(job.ID, after, writeChunk)
+		data, _ := json.Marshal(map[string]string{"status": current.Status})
+		fmt.Fprintf(w, "event: end\ndata: %s\n\n", data)
+		flusher.Flush()
+		return true
+	}
+
+	if err := replay(job.ID, after, writeChunk); err != nil {
+		log.Printf("Failed to replay logs for job %s: %v\n", job.ID, err)
+		return
+	}
+	flusher.Flush()
+	if ended() {
+		return
+	}
+
+	keepalive := time.NewTicker(logKeepaliveInterval)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case chunk, ok := <-live:
+			if !ok {
+				// Either the job finished or this reader was too slow and the client has to resume
+				ended()
+				return
+			}
+			if chunk.Seq <= after {
+				continue
+			}
+			writeChunk(chunk)
+			flusher.Flush()
+		case <-keepalive.C:
+			if ended() {
+				return
+			}
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+// replay writes every stored chunk of a job after the given sequence number
+func replay(jobID string, after int64, write func(protocol.JobLogPayload)) error {
+	var chunks []db.JobLog
+	if err := db.DB.Where("job_id = ? AND seq > ?", jobID, after).Order("seq").Find(&chunks).Error; err != nil {
+		return err
+	}
+	for _, c := range chunks {
+		write(protocol.JobLogPayload{
+			JobID:  c.JobID,
+			Seq:    c.Seq,
+			Stream: c.Stream,
+			Data:   c.Data,
+		})
+	}
+	return nil
+}
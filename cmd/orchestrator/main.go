@@ -4,8 +4,10 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
@@ -17,7 +19,9 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/gridforce/core/internal/core/blockchain"
 	"github.com/gridforce/core/internal/core/db"
+	"github.com/gridforce/core/internal/core/scheduler"
 	"github.com/gridforce/core/pkg/protocol"
+	"gorm.io/gorm"
 )
 
 // ProviderSession holds information about a connected provider
@@ -26,25 +30,126 @@ type ProviderSession struct {
 	DeviceID       string
 	WalletAddress  string
 	Specs          string
+	OS             string
+	Arch           string
+	CpuCores       int
 	IP             string
 	Status         string
 	LastSeen       time.Time
 	Tokens         int64
 	BenchmarkScore int
+	OffersAccepted int64
+	OffersRejected int64
+	Sandbox        protocol.SandboxSpec
+	// Prices advertised by the provider; zero rates stand for the default prices
+	Prices         protocol.Prices
+	Version        int      // negotiated protocol version
+	Features       []string // negotiated optional features
+	Slots          int
+	FreeSlots      int // as last advertised by the provider
+	Load1          float64
+	MemUsedPercent float64
+	// Jobs assigned to this provider, by job ID
+	Jobs map[string]*assignment
+	// Chunked outputs received ahead of their JOB_RESULT; used by the read loop only
+	blobs *protocol.Assembler
+
+	// Messages waiting for the session's writer goroutine, the connection's only writer
+	outbound  chan protocol.Message
+	done      chan struct{} // closed when the session ends
+	stopped   chan struct{} // closed when the writer has exited
+	closeOnce sync.Once
+}
+
+// assignment is a job placed on a provider
+type assignment struct {
+	Cores      int
+	LogSeqBase int64
+	OfferID    string // ID of the JOB_OFFER message, answered by ACK or ERROR
+	// OfferTimer runs until the provider accepts or rejects the offer; nil once answered
+	OfferTimer *time.Timer
+}
+
+// send encodes a payload and writes it to the provider
+func (s *ProviderSession) send(payload protocol.Payload) error {
+	msg, err := protocol.Encode(payload)
+	if err != nil {
+		return err
+	}
+	return s.write(msg)
+}
+
+// reply answers a message from the provider
+func (s *ProviderSession) reply(to protocol.Message, payload protocol.Payload) error {
+	msg, err := protocol.EncodeReply(to, payload)
+	if err != nil {
+		return err
+	}
+	return s.write(msg)
+}
+
+// replyError answers a message from the provider with an ERROR
+func (s *ProviderSession) replyError(to protocol.Message, code, message string) {
+	if err := s.reply(to, protocol.ErrorPayload{Code: code, Message: message}); err != nil {
+		log.Printf("Failed to send %s error to %s: %v\n", code, s.DeviceID, err)
+	}
+}
+
+// offerJob returns the job an offer message was for, if it is still assigned to the provider
+func (s *ProviderSession) offerJob(offerID string) string {
+	if offerID == "" {
+		return ""
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	for jobID, a := range s.Jobs {
+		if a.OfferID == offerID {
+			return jobID
+		}
+	}
+	return ""
+}
+
+// supports reports whether a protocol feature was negotiated with the provider
+func (s *ProviderSession) supports(feature string) bool {
+	return protocol.HasFeature(s.Features, feature)
+}
+
+// usedCores returns the cores claimed by the provider's assigned jobs
+func (s *ProviderSession) usedCores() int {
+	used := 0
+	for _, a := range s.Jobs {
+		used += a.Cores
+	}
+	return used
+}
+
+// activeJobs returns how many slots are occupied, trusting whichever of our own assignments
+// and the provider's last capacity report is higher
+func (s *ProviderSession) activeJobs() int {
+	if busy := s.Slots - s.FreeSlots; busy > len(s.Jobs) {
+		return busy
+	}
+	return len(s.Jobs)
 }
 
 var (
-	// Store active connections: RemoteAddr -> *ProviderSession
+	// Store authenticated connections: node (device) ID -> *ProviderSession
 	providers = make(map[string]*ProviderSession)
 	mu        sync.RWMutex
 
 	// Blockchain Client
 	chainClient *blockchain.Client
 
+	// Placement policy used by the dispatcher
+	sched scheduler.Scheduler
+
 	upgrader = websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool {
 			return true // Allow all origins for dev
 		},
+		// Negotiate permessage-deflate with providers that offer it
+		EnableCompression: true,
 	}
 )
 
@@ -67,200 +172,446 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	addr := conn.RemoteAddr().String()
 	log.Printf("New Provider Connected: %s\n", addr)
 
+	// Placeholder session; it is registered under its node ID once the provider authenticates
+	session := newProviderSession(conn, addr)
+	nodeID := ""
+	var connection *db.NodeConnection
+
 	// cleanup handler
 	defer func() {
+		session.close()
 		conn.Close()
+		if nodeID == "" {
+			log.Printf("Provider Disconnected: %s (never authenticated)\n", addr)
+			return
+		}
+
 		mu.Lock()
-		delete(providers, addr)
+		var inFlight []string
+		for jobID, a := range session.Jobs {
+			inFlight = append(inFlight, jobID)
+			// Unanswered offers wait for the reconnect grace period like every other job
+			if a.OfferTimer != nil {
+				a.OfferTimer.Stop()
+			}
+		}
+		// A newer connection from the same node may already have replaced this one
+		registered, ok := providers[nodeID]
+		current := !ok || registered == session
+		if ok && current {
+			delete(providers, nodeID)
+		}
 		mu.Unlock()
-		log.Printf("Provider Disconnected: %s\n", addr)
+		log.Printf("Provider Disconnected: %s (%s)\n", nodeID, addr)
+
+		if connection != nil {
+			if err := db.CloseConnection(connection.ID); err != nil {
+				log.Printf("Failed to record disconnect of %s: %v\n", nodeID, err)
+			}
+		}
+
+		// A newer connection has already resumed the node's jobs
+		if !current {
+			return
+		}
+		db.DB.Model(&db.Node{}).Where("id = ?", nodeID).Update("status", "OFFLINE")
+
+		// Jobs in flight wait for the node to reconnect before going back to the queue
+		scheduleRequeue(nodeID, inFlight)
 	}()
 
-	// Initial placeholder registration (unauthenticated)
-	mu.Lock()
-	providers[addr] = &ProviderSession{
-		Conn:     conn,
-		IP:       addr,
-		Status:   "CONNECTED", 
-		LastSeen: time.Now(),
-	}
-	mu.Unlock()
+	// Liveness: providers that neither send messages nor answer the writer's pings for
+	// heartbeatMissLimit intervals hit the read deadline and are dropped
+	conn.SetReadDeadline(time.Now().Add(readTimeout()))
+	conn.SetReadLimit(maxMessageSize)
+	conn.SetPongHandler(func(string) error {
+		markAlive(conn, session)
+		return nil
+	})
 
-	// Update DB Status - Initial
-	node := db.Node{
-		ID:        addr,
-		IPAddress: addr,
-		Status:    "CONNECTED",
-		LastSeen:  time.Now(),
+	// Challenge the provider to prove it owns the wallet it will claim
+	challenge, err := newNonce()
+	if err != nil {
+		log.Println("Failed to create challenge:", err)
+		return
 	}
-	db.DB.Save(&node)
+	if err := session.send(protocol.ChallengePayload{Nonce: challenge}); err != nil {
+		log.Println("Failed to send challenge:", err)
+		return
+	}
+	authenticated := false
 
 	// Listen for messages
 	for {
-		_, message, err := conn.ReadMessage()
+		frameType, message, err := conn.ReadMessage()
 		if err != nil {
-			log.Println("Read error:", err)
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				log.Printf("Provider %s missed %d heartbeats, marking OFFLINE\n", addr, heartbeatMissLimit)
+			} else if errors.Is(err, websocket.ErrReadLimit) {
+				log.Printf("Provider %s sent a message over %d bytes, disconnecting\n", addr, maxMessageSize)
+			} else {
+				log.Println("Read error:", err)
+			}
 			break
 		}
+		markAlive(conn, session)
+
+		// Binary frames carry chunks of large outputs
+		if frameType == websocket.BinaryMessage {
+			if authenticated && session.supports(protocol.FeatureChunks) {
+				handleChunk(session, message)
+			} else {
+				log.Printf("Ignoring binary frame from %s\n", addr)
+			}
+			continue
+		}
 
 		var msg protocol.Message
 		if err := json.Unmarshal(message, &msg); err != nil {
 			log.Printf("Error unmarshalling message: %v\n", err)
+			session.replyError(msg, protocol.ErrCodeBadMessage, err.Error())
+			continue
+		}
+
+		// Nothing but AUTH is accepted until the provider has proven its identity
+		if !authenticated && msg.Type != protocol.TypeAuth {
+			log.Printf("Ignoring %s from unauthenticated provider %s\n", msg.Type, addr)
+			session.replyError(msg, protocol.ErrCodeUnauthenticated, "authenticate first")
 			continue
 		}
 
 		// Handle Auth to capture DeviceID and Wallet
 		if msg.Type == protocol.TypeAuth {
-			// DEBUG: Print Raw Payload
-			log.Printf("DEBUG: Raw Auth Payload: %s", string(msg.Payload))
+			if authPayload, err := protocol.Decode[protocol.AuthPayload](msg); err == nil {
+				// Agree on a protocol version before anything else
+				hello, rejection := protocol.Negotiate(authPayload)
+				hello.MaxMessageSize = maxMessageSize
+				if rejection != nil {
+					log.Printf("Provider %s rejected: %v\n", addr, rejection)
+					session.reply(msg, *rejection)
+					break
+				}
+				if p := authPayload.Prices; p.CoreHour < 0 || p.MemoryGBHour < 0 || p.WallHour < 0 {
+					log.Printf("Provider %s rejected: negative prices %+v\n", addr, p)
+					session.replyError(msg, protocol.ErrCodeBadMessage, "prices must not be negative")
+					break
+				}
 
-			var authPayload protocol.AuthPayload
-			if err := json.Unmarshal(msg.Payload, &authPayload); err == nil {
-				// DEBUG: Print Parsed Values
-				log.Printf("DEBUG: Parsed Specs: OS=%s Arch=%s Cores=%d", authPayload.OS, authPayload.Arch, authPayload.CpuCores)
+				// Verify the wallet signature; the challenge is single use
+				wallet, err := verifyProviderAuth(challenge, authPayload)
+				challenge = ""
+				if err != nil {
+					log.Printf("Provider %s failed authentication: %v\n", addr, err)
+					session.replyError(msg, protocol.ErrCodeAuthFailed, err.Error())
+					break
+				}
+				authPayload.WalletAddress = wallet
+				authenticated = true
 
 				// Construct dynamic specs string
 				specsStr := fmt.Sprintf("%s/%s - %d Cores", authPayload.OS, authPayload.Arch, authPayload.CpuCores)
 
+				// Restore tokens & benchmark from DB if the device is already known
+				nodeID = authPayload.DeviceID
+				var node db.Node
+				known := db.DB.First(&node, "id = ?", nodeID).Error == nil
+				if !known {
+					node = db.Node{ID: nodeID}
+				}
+				if node.BannedAt != nil {
+					log.Printf("Provider %s rejected: node %s is banned (%s)\n", addr, nodeID, node.BanReason)
+					session.replyError(msg, protocol.ErrCodeAuthFailed, "node banned: "+node.BanReason)
+					// Leave the node's jobs to the requeue scheduled when it was disconnected
+					nodeID = ""
+					break
+				}
+
+				// A node has one live session; an older connection from it is dropped. The new
+				// session is registered together with cancelling the pending requeue, so the old
+				// session's cleanup cannot schedule another one in between. It is not ONLINE
+				// until HELLO went out, so no offer precedes HELLO.
+				mu.Lock()
+				previous := providers[nodeID]
+				providers[nodeID] = session
+				cancelRequeue(nodeID)
+				mu.Unlock()
+				if previous != nil {
+					log.Printf("Node %s reconnected from %s, closing its connection from %s\n", nodeID, addr, previous.IP)
+					previous.Conn.Close()
+				}
+
+				// Resume the jobs the node still holds from its previous connection
+				held := authPayload.JobIDs
+				if !protocol.HasFeature(hello.Features, protocol.FeatureResume) {
+					held = nil
+				}
+				resumed, requeued, err := db.ResumeNodeJobs(nodeID, held)
+				if err != nil {
+					log.Printf("Failed to resume jobs of %s: %v\n", nodeID, err)
+				} else if requeued > 0 {
+					log.Printf("Requeued %d job(s) %s no longer holds\n", requeued, nodeID)
+					wakeDispatcher()
+				}
+
 				mu.Lock()
-				if session, ok := providers[addr]; ok {
-					session.DeviceID = authPayload.DeviceID
-					session.WalletAddress = authPayload.WalletAddress
-					session.Specs = specsStr
-					session.Status = "ONLINE"
-					session.LastSeen = time.Now()
-
-					// Restore tokens & benchmark from DB if checking against existing record
-					var storedNode db.Node
-					if err := db.DB.First(&storedNode, "id = ?", addr).Error; err == nil {
-						session.Tokens = storedNode.Tokens
-						session.BenchmarkScore = storedNode.BenchmarkScore
-					}
+				for i := range resumed {
+					job := &resumed[i]
+					session.Jobs[job.ID] = &assignment{Cores: jobCores(job), LogSeqBase: job.LogSeqBase}
+				}
+				session.DeviceID = authPayload.DeviceID
+				session.WalletAddress = authPayload.WalletAddress
+				session.Specs = specsStr
+				session.OS = authPayload.OS
+				session.Arch = authPayload.Arch
+				session.CpuCores = authPayload.CpuCores
+				session.Sandbox = authPayload.Sandbox
+				session.Prices = authPayload.Prices
+				session.Version = hello.Version
+				session.Features = hello.Features
+				// Providers that predate slot advertising run one job at a time
+				session.Slots = authPayload.Slots
+				if session.Slots < 1 {
+					session.Slots = 1
+				}
+				session.FreeSlots = session.Slots
+				session.LastSeen = time.Now()
+				session.Tokens = node.Tokens
+				session.BenchmarkScore = node.BenchmarkScore
+				session.OffersAccepted = node.OffersAccepted
+				session.OffersRejected = node.OffersRejected
+
+				mu.Unlock()
+
+				// HELLO goes out before the session is ONLINE, so it precedes any offer
+				if err := session.reply(msg, hello); err != nil {
+					log.Printf("Failed to send hello to %s: %v\n", nodeID, err)
+					break
 				}
+				mu.Lock()
+				session.Status = "ONLINE"
 				mu.Unlock()
 
-				// Update DB with DeviceID, Wallet, and Specs
+				// Update DB with Address, Wallet, and Specs. Only these columns are written, so
+				// tokens and offer counts settled since the node was loaded are kept.
+				node.IPAddress = addr
 				node.WalletAddress = authPayload.WalletAddress
 				node.Specs = specsStr
 				node.Status = "ONLINE"
 				node.LastSeen = time.Now()
-				db.DB.Save(&node)
-				
-				fmt.Printf("Provider Authenticated: %s | Wallet: %s | Specs: %s\n", authPayload.DeviceID, authPayload.WalletAddress, specsStr)
+				if known {
+					err = db.DB.Model(&db.Node{}).Where("id = ?", nodeID).Updates(map[string]interface{}{
+						"ip_address":     node.IPAddress,
+						"wallet_address": node.WalletAddress,
+						"specs":          node.Specs,
+						"status":         node.Status,
+						"last_seen":      node.LastSeen,
+					}).Error
+				} else {
+					err = db.DB.Create(&node).Error
+				}
+				if err != nil {
+					log.Printf("Failed to store node %s: %v\n", nodeID, err)
+				}
+
+				if connection, err = db.OpenConnection(nodeID, addr, authPayload.WalletAddress); err != nil {
+					log.Printf("Failed to record connection of %s: %v\n", nodeID, err)
+				}
+
+				fmt.Printf("Provider Authenticated: %s | Wallet: %s | Specs: %s | Protocol: v%d %v | Resumed Jobs: %d\n", authPayload.DeviceID, authPayload.WalletAddress, specsStr, hello.Version, hello.Features, len(resumed))
+				wakeDispatcher()
 			} else {
 				log.Printf("Error unmarshalling auth payload: %v", err)
+				session.replyError(msg, protocol.ErrCodeBadMessage, err.Error())
+				break
 			}
 		}
 
-		if msg.Type == protocol.TypeJobResult {
-			var result string
-			json.Unmarshal(msg.Payload, &result)
-			fmt.Printf("Job Result: %s\n", result)
+		if msg.Type == protocol.TypeJobStarted {
+			started, err := protocol.Decode[protocol.JobStartedPayload](msg)
+			if err != nil {
+				log.Printf("Error unmarshalling job started payload: %v", err)
+				session.replyError(msg, protocol.ErrCodeBadMessage, err.Error())
+				continue
+			}
+			if err := db.TransitionNodeJob(started.JobID, nodeID, db.JobRunning, nil); err != nil {
+				log.Printf("Job %s could not be marked running: %v\n", started.JobID, err)
+			}
+		}
 
-			// Determine DeviceID for record and reward
-			mu.Lock()
-			deviceID := "unknown"
-			walletAddr := ""
-			
-			// Benchmark Logic
-			isBenchmark := false
-			benchmarkScore := 0
-			if strings.Contains(result, "BENCHMARK_SCORE:") {
-				isBenchmark = true
-				parts := strings.Split(result, "BENCHMARK_SCORE:")
-				if len(parts) > 1 {
-					scoreStr := strings.TrimSpace(parts[1])
-					if s, err := strconv.Atoi(scoreStr); err == nil {
-						benchmarkScore = s
-					}
-				}
+		if msg.Type == protocol.TypeHeartbeat {
+			hb, err := protocol.Decode[protocol.HeartbeatPayload](msg)
+			if err != nil {
+				log.Printf("Error unmarshalling heartbeat payload: %v", err)
+				session.replyError(msg, protocol.ErrCodeBadMessage, err.Error())
+				continue
 			}
+			handleHeartbeat(nodeID, session, hb)
+		}
 
-			if sess, ok := providers[addr]; ok {
-				deviceID = sess.DeviceID
-				walletAddr = sess.WalletAddress
-				
-				// Reward Tokens (DB Tracking) ONLY if NOT a benchmark or maybe small reward?
-				// User said: "Do NOT mint tokens for benchmark jobs (optional)"
-				// Let's Skip token increase for benchmarks to avoid spamming
-				if !isBenchmark {
-					sess.Tokens += 10
-				} else {
-					// Update Session Score
-					sess.BenchmarkScore = benchmarkScore
-				}
+		if msg.Type == protocol.TypeCapacity {
+			capacity, err := protocol.Decode[protocol.CapacityPayload](msg)
+			if err != nil {
+				log.Printf("Error unmarshalling capacity payload: %v", err)
+				session.replyError(msg, protocol.ErrCodeBadMessage, err.Error())
+				continue
+			}
+			mu.Lock()
+			if capacity.Slots > 0 {
+				session.Slots = capacity.Slots
+				session.FreeSlots = capacity.FreeSlots
 			}
 			mu.Unlock()
+			wakeDispatcher()
+		}
 
-			// Save Job Result
-			job := db.Job{
-				NodeID: deviceID, // Use DeviceID if available, else unknown
-				Image:  "alpine",
-				Status: "COMPLETED",
-				Result: result,
-			}
-			db.DB.Create(&job)
-
-			// Update Node Tokens/Score in DB
-			var dbNode db.Node
-			if err := db.DB.First(&dbNode, "id = ?", addr).Error; err == nil {
-				if isBenchmark {
-					dbNode.BenchmarkScore = benchmarkScore
-					log.Printf("Node %s Benchmark Updated: %d\n", deviceID, benchmarkScore)
-				} else {
-					dbNode.Tokens += 10
-				}
-				db.DB.Save(&dbNode)
+		if msg.Type == protocol.TypeJobLog {
+			chunk, err := protocol.Decode[protocol.JobLogPayload](msg)
+			if err != nil {
+				log.Printf("Error unmarshalling job log payload: %v", err)
+				session.replyError(msg, protocol.ErrCodeBadMessage, err.Error())
+				continue
 			}
-			
-			if !isBenchmark {
-				log.Printf("Job Saved: %d | Node Rewarded: %s (+10 Tokens)\n", job.ID, deviceID)
-
-				// Mint Tokens on Blockchain
-				if chainClient != nil && walletAddr != "" && walletAddr != "0x000000000000000000000000000000000000dead" {
-					tx, err := chainClient.MintToken(walletAddr, 10)
-					if err != nil {
-						log.Printf("Blockchain Error: Failed to mint tokens: %v\n", err)
-					} else {
-						log.Printf("Blockchain Tx Sent: %s | Minted 10 GRID to %s\n", tx, walletAddr)
-					}
-				} else {
-					log.Println("Skipping Blockchain Mint: Client not init or invalid wallet")
-				}
-			} else {
-				log.Printf("Benchmark Job Completed: Score %d", benchmarkScore)
+			handleJobLog(session, chunk)
+		}
+
+		if msg.Type == protocol.TypeJobAccept {
+			accept, err := protocol.Decode[protocol.JobAcceptPayload](msg)
+			if err != nil {
+				log.Printf("Error unmarshalling job accept payload: %v", err)
+				session.replyError(msg, protocol.ErrCodeBadMessage, err.Error())
+				continue
 			}
+			handleJobAccept(session, msg, accept)
 		}
-	}
-}
 
-// Auth Middleware
-func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		apiKey := r.Header.Get("X-API-KEY")
-		if apiKey == "" {
-			http.Error(w, "Unauthorized: Validation Failed", http.StatusUnauthorized)
-			return
+		if msg.Type == protocol.TypeJobReject {
+			reject, err := protocol.Decode[protocol.JobRejectPayload](msg)
+			if err != nil {
+				log.Printf("Error unmarshalling job reject payload: %v", err)
+				session.replyError(msg, protocol.ErrCodeBadMessage, err.Error())
+				continue
+			}
+			handleJobReject(session, msg, reject)
 		}
 
-		var customer db.Customer
-		if err := db.DB.Where("api_key = ?", apiKey).First(&customer).Error; err != nil {
-			http.Error(w, "Unauthorized: Invalid API Key", http.StatusUnauthorized)
-			return
+		if msg.Type == protocol.TypeAck {
+			if jobID := session.offerJob(msg.ReplyTo); jobID != "" {
+				log.Printf("Offer for job %s acknowledged by %s\n", jobID, nodeID)
+			}
 		}
 
-		if customer.Credits <= 0 {
-			http.Error(w, "Payment Required: Insufficient Credits", http.StatusPaymentRequired)
-			return
+		if msg.Type == protocol.TypeError {
+			providerErr, err := protocol.Decode[protocol.ErrorPayload](msg)
+			if err != nil {
+				log.Printf("Error unmarshalling error payload: %v", err)
+				continue
+			}
+			log.Printf("Provider %s reported %v (reply to %s)\n", nodeID, providerErr, msg.ReplyTo)
+			handleOfferError(session, msg, providerErr)
 		}
 
-		// Deduct Credit
-		customer.Credits -= 1
-		db.DB.Save(&customer)
+		if msg.Type == protocol.TypeJobResult {
+			payload, err := protocol.Decode[protocol.JobResultPayload](msg)
+			if err != nil {
+				log.Printf("Error unmarshalling job result payload: %v", err)
+				session.replyError(msg, protocol.ErrCodeBadMessage, err.Error())
+				continue
+			}
+			if err := resolveBlobs(session, &payload); err != nil {
+				log.Printf("Result for job %s from %s incomplete: %v\n", payload.JobID, nodeID, err)
+				session.replyError(msg, protocol.ErrCodeInternal, err.Error())
+				continue
+			}
+			if payload.ExitCode != nil {
+				fmt.Printf("Job Result [%s]: exit code %d, %d bytes of output\n", payload.JobID, *payload.ExitCode, len(payload.Stdout))
+			} else {
+				fmt.Printf("Job Result [%s]: no exit code, %d bytes of output\n", payload.JobID, len(payload.Stdout))
+			}
+
+			// Match the result to the job it was offered for
+			var job db.Job
+			if err := db.DB.First(&job, "id = ?", payload.JobID).Error; err != nil {
+				log.Printf("Result for unknown job %s from %s dropped\n", payload.JobID, nodeID)
+				session.replyError(msg, protocol.ErrCodeUnknownJob, "unknown job "+payload.JobID)
+				continue
+			}
+			if job.NodeID != nodeID {
+				log.Printf("Result for job %s from %s dropped: job is assigned to %s\n", job.ID, nodeID, job.NodeID)
+				session.replyError(msg, protocol.ErrCodeNotAssigned, "job "+job.ID+" is not assigned to this node")
+				continue
+			}
+			releaseSlot(session, job.ID)
+
+			if job.Status == db.JobCancelled {
+				log.Printf("Result for cancelled job %s ignored\n", job.ID)
+				session.reply(msg, protocol.AckPayload{})
+				continue
+			}
+			// Results re-sent after a reconnect may already have been recorded
+			if db.IsTerminal(job.Status) {
+				log.Printf("Duplicate result for job %s ignored (already %s)\n", job.ID, job.Status)
+				session.replyError(msg, protocol.ErrCodeDuplicateResult, "result for job "+job.ID+" already recorded")
+				continue
+			}
+
+			usage := meteredUsage(&job, &payload)
+			if payload.Error != "" || payload.FailureReason != "" {
+				// Timeouts get their own terminal state; everything else is a failure
+				status := db.JobFailed
+				if payload.FailureReason == protocol.FailureTimeout {
+					status = db.JobTimedOut
+				}
+				err := db.TransitionNodeJob(job.ID, nodeID, status, resultUpdates(&payload, usage))
+				jobLogs.close(job.ID)
+				if err != nil {
+					log.Printf("Job %s could not be marked %s: %v\n", job.ID, status, err)
+					session.replyError(msg, protocol.ErrCodeInternal, "result not recorded")
+				} else {
+					log.Printf("Job %s %s (%s): %s\n", job.ID, status, payload.FailureReason, payload.Error)
+					session.reply(msg, protocol.AckPayload{})
+					rewardProvider(&job, settleJob(&job, status, payload.FailureReason, usage))
+				}
+				continue
+			}
+
+			err = db.TransitionNodeJob(job.ID, nodeID, db.JobSucceeded, resultUpdates(&payload, usage))
+			jobLogs.close(job.ID)
+			if err != nil {
+				log.Printf("Job %s could not be marked succeeded: %v\n", job.ID, err)
+				session.replyError(msg, protocol.ErrCodeInternal, "result not recorded")
+				continue
+			}
+			session.reply(msg, protocol.AckPayload{})
+			rewardProvider(&job, settleJob(&job, db.JobSucceeded, "", usage))
+			if !job.Benchmark {
+				continue
+			}
+
+			// Benchmark jobs update the score of the node that ran them
+			score, ok := benchmarkScore(payload.Stdout)
+			if !ok {
+				log.Printf("Benchmark job %s on %s reported no score\n", job.ID, nodeID)
+				continue
+			}
+			mu.Lock()
+			session.BenchmarkScore = score
+			mu.Unlock()
+			if err := db.DB.Model(&db.Node{}).Where("id = ?", nodeID).Update("benchmark_score", score).Error; err != nil {
+				log.Printf("Failed to store benchmark of %s: %v\n", nodeID, err)
+			} else {
+				log.Printf("Node %s Benchmark Updated: %d\n", nodeID, score)
+			}
+		}
+	}
+}
 
-		// Proceed
-		next(w, r)
+// benchmarkScore reads the score a benchmark job printed as its only output
+func benchmarkScore(stdout string) (int, bool) {
+	score, err := strconv.Atoi(strings.TrimSpace(stdout))
+	if err != nil || score < 0 {
+		return 0, false
 	}
+	return score, true
 }
 
 func handleJobDispatch(w http.ResponseWriter, r *http.Request) {
@@ -270,45 +621,93 @@ func handleJobDispatch(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req struct {
-		Image string   `json:"image"`
-		Cmd   []string `json:"cmd"`
+		Image        string   `json:"image"`
+		Cmd          []string `json:"cmd"`
+		Requirements struct {
+			MinCores          int    `json:"min_cores"`
+			Platform          string `json:"platform"`
+			MinBenchmarkScore int    `json:"min_benchmark_score"`
+		} `json:"requirements"`
+		Resources protocol.ResourceLimits `json:"resources"`
+		Sandbox   protocol.SandboxSpec    `json:"sandbox"`
+		// MaxPrice caps what the job may cost in credits; by default it may cost as much as
+		// on a provider charging the default rates
+		MaxPrice int64 `json:"max_price"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	mu.RLock()
-	if len(providers) == 0 {
-		mu.RUnlock()
-		http.Error(w, "No providers available", http.StatusServiceUnavailable)
+	if req.Image == "" {
+		http.Error(w, "Image is required", http.StatusBadRequest)
 		return
 	}
-
-	// Pick first available provider
-	var targetConn *websocket.Conn
-	for _, sess := range providers {
-		targetConn = sess.Conn
-		break
+	if req.Requirements.MinCores < 0 || req.Requirements.MinBenchmarkScore < 0 {
+		http.Error(w, "Requirements must not be negative", http.StatusBadRequest)
+		return
 	}
-	mu.RUnlock()
-
-	// Create Offer
-	offerPayload, _ := json.Marshal(req)
-	msg := protocol.Message{
-		Type:    protocol.TypeJobOffer,
-		Payload: offerPayload,
+	if res := req.Resources; res.CPUs < 0 || res.MemoryMB < 0 || res.PidsLimit < 0 || res.ShmSizeMB < 0 || res.TimeoutSeconds < 0 {
+		http.Error(w, "Resource limits must not be negative", http.StatusBadRequest)
+		return
+	}
+	if req.MaxPrice < 0 {
+		http.Error(w, "Max price must not be negative", http.StatusBadRequest)
+		return
+	}
+	if p := req.Requirements.Platform; p != "" && !strings.Contains(p, "/") {
+		http.Error(w, "Platform must be in os/arch form, e.g. linux/arm64", http.StatusBadRequest)
+		return
 	}
 
-	if err := targetConn.WriteJSON(msg); err != nil {
-		log.Println("Failed to send job offer:", err)
-		http.Error(w, "Failed to dispatch job", http.StatusInternalServerError)
+	// Persist the job; the dispatcher hands it to a provider once one is free
+	job := db.Job{
+		ID:         uuid.New().String(),
+		CustomerID: customerFromContext(r).ID,
+		Image:      req.Image,
+		Cmd:        req.Cmd,
+		Status:     db.JobQueued,
+
+		MinCores:          req.Requirements.MinCores,
+		Platform:          req.Requirements.Platform,
+		MinBenchmarkScore: req.Requirements.MinBenchmarkScore,
+
+		CPUs:           req.Resources.CPUs,
+		MemoryMB:       req.Resources.MemoryMB,
+		PidsLimit:      req.Resources.PidsLimit,
+		ShmSizeMB:      req.Resources.ShmSizeMB,
+		TimeoutSeconds: req.Resources.TimeoutSeconds,
+
+		NeedsNetwork:        req.Sandbox.Network,
+		NeedsWritableRootfs: req.Sandbox.WritableRootfs,
+		NeedsRoot:           req.Sandbox.RunAsRoot,
+	}
+	// Hold the most the job can cost; it is settled against metered usage when it ends and
+	// only placed on providers where it stays within that price
+	job.MaxPrice = req.MaxPrice
+	if job.MaxPrice == 0 {
+		job.MaxPrice = referencePrice(&job)
+	}
+	reserve := job.MaxPrice
+	if err := db.SubmitJob(&job, reserve); err != nil {
+		if errors.Is(err, db.ErrInsufficientCredits) {
+			http.Error(w, fmt.Sprintf("Payment Required: job needs a hold of %d credits", reserve), http.StatusPaymentRequired)
+			return
+		}
+		http.Error(w, "Failed to create job", http.StatusInternalServerError)
 		return
 	}
+	wakeDispatcher()
 
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Job dispatched"))
-	log.Printf("Job dispatched to %s\n", targetConn.RemoteAddr())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"job_id":    job.ID,
+		"status":    job.Status,
+		"max_price": job.MaxPrice,
+		"reserved":  job.Reserved,
+	})
+	log.Printf("Job %s queued (%s), max price %d, %d credits held\n", job.ID, job.Image, job.MaxPrice, job.Reserved)
 }
 
 // API: Get Active Nodes
@@ -316,13 +715,16 @@ func handleGetNodes(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	
 	type NodeResponse struct {
-		Device          string `json:"device"`
-		Wallet          string `json:"wallet"`
-		Specs           string `json:"specs"`
-		IP              string `json:"ip"`
-		Status          string `json:"status"`
-		Tokens          int64  `json:"tokens"`
-		BenchmarkScore  int    `json:"benchmark_score"`
+		Device         string          `json:"device"`
+		Wallet         string          `json:"wallet"`
+		Specs          string          `json:"specs"`
+		IP             string          `json:"ip"`
+		Status         string          `json:"status"`
+		Tokens         int64           `json:"tokens"`
+		BenchmarkScore int             `json:"benchmark_score"`
+		OffersAccepted int64           `json:"offers_accepted"`
+		OffersRejected int64           `json:"offers_rejected"`
+		Prices         protocol.Prices `json:"prices"`
 	}
 
 	mu.RLock()
@@ -331,13 +733,16 @@ func handleGetNodes(w http.ResponseWriter, r *http.Request) {
 	var nodes []NodeResponse
 	for _, sess := range providers {
 		nodes = append(nodes, NodeResponse{
-			Device:          sess.DeviceID,
-			Wallet:          sess.WalletAddress,
-			Specs:           sess.Specs,
-			IP:              sess.IP,
-			Status:          sess.Status,
-			Tokens:          sess.Tokens,
-			BenchmarkScore:  sess.BenchmarkScore,
+			Device:         sess.DeviceID,
+			Wallet:         sess.WalletAddress,
+			Specs:          sess.Specs,
+			IP:             sess.IP,
+			Status:         sess.Status,
+			Tokens:         sess.Tokens,
+			BenchmarkScore: sess.BenchmarkScore,
+			OffersAccepted: sess.OffersAccepted,
+			OffersRejected: sess.OffersRejected,
+			Prices:         sess.Prices,
 		})
 	}
 	json.NewEncoder(w).Encode(nodes)
@@ -348,8 +753,8 @@ func handleGetJobs(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	
 	var jobs []db.Job
-	// Get last 10 jobs order by ID desc
-	if result := db.DB.Order("id desc").Limit(10).Find(&jobs); result.Error != nil {
+	// Get last 10 jobs order by creation time desc
+	if result := db.DB.Order("created_at desc").Limit(10).Find(&jobs); result.Error != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
@@ -357,30 +762,97 @@ func handleGetJobs(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(jobs)
 }
 
-// API: Admin Create Customer
-func handleCreateCustomer(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+// API: Get Job Status (owner only)
+func handleGetJob(w http.ResponseWriter, r *http.Request) {
+	customer := customerFromContext(r)
+
+	var job db.Job
+	if err := db.DB.First(&job, "id = ? AND customer_id = ?", r.PathValue("id"), customer.ID).Error; err != nil {
+		http.Error(w, "Job not found", http.StatusNotFound)
 		return
 	}
 
-	newKey := generateRandomKey()
-	customer := db.Customer{
-		ID:      uuid.New().String(),
-		ApiKey:  newKey,
-		Credits: 1000,
-	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":                    job.ID,
+		"status":                job.Status,
+		"image":                 job.Image,
+		"cmd":                   job.Cmd,
+		"node_id":               job.NodeID,
+		"created_at":            job.CreatedAt,
+		"assigned_at":           job.AssignedAt,
+		"started_at":            job.StartedAt,
+		"finished_at":           job.FinishedAt,
+		"exit_code":             job.ExitCode,
+		"image_digest":          job.ImageDigest,
+		"pulled_at":             job.PulledAt,
+		"container_started_at":  job.ContainerStartedAt,
+		"container_finished_at": job.ContainerFinishedAt,
+		"stdout":                job.Result,
+		"stderr":                job.Stderr,
+		"stdout_truncated":      job.StdoutTruncated,
+		"stderr_truncated":      job.StderrTruncated,
+		"error":                 job.Error,
+		"failure_reason":        job.FailureReason,
+		"usage": map[string]interface{}{
+			"cpu_seconds":       job.CPUSeconds,
+			"memory_gb_seconds": job.MemoryGBSeconds,
+			"wall_seconds":      job.WallSeconds,
+		},
+		"max_price": job.MaxPrice,
+		"rates": map[string]interface{}{
+			"core_hour":      job.Rates.CoreHour,
+			"memory_gb_hour": job.Rates.MemoryGBHour,
+			"wall_hour":      job.Rates.WallHour,
+		},
+		"reserved":        job.Reserved,
+		"cost":            job.Cost,
+		"provider_reward": job.ProviderReward,
+		"platform_fee":    job.PlatformFee,
+		"settled_at":      job.SettledAt,
+	})
+}
+
+// API: Cancel Job (owner only)
+func handleCancelJob(w http.ResponseWriter, r *http.Request) {
+	customer := customerFromContext(r)
 
-	if err := db.DB.Create(&customer).Error; err != nil {
-		http.Error(w, "Failed to create customer", http.StatusInternalServerError)
+	job, err := db.CancelJob(r.PathValue("id"), customer.ID, cancelCharge)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, db.ErrInvalidTransition) {
+		http.Error(w, "Job already finished", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to cancel job", http.StatusInternalServerError)
 		return
 	}
 
+	// Stop the container if the job already reached a provider
+	if job.Status == db.JobAssigned || job.Status == db.JobRunning {
+		mu.RLock()
+		sess, ok := providers[job.NodeID]
+		mu.RUnlock()
+		if ok && sess.supports(protocol.FeatureJobCancel) {
+			if err := sess.send(protocol.JobCancelPayload{JobID: job.ID}); err != nil {
+				log.Printf("Failed to send cancel for job %s to %s: %v\n", job.ID, job.NodeID, err)
+			}
+		}
+	}
+	jobLogs.close(job.ID)
+
+	log.Printf("Job %s cancelled by customer %s (was %s, charged %d of %d held)\n", job.ID, customer.ID, job.Status, job.Cost, job.Reserved)
+	rewardProvider(job, pricer.Split(job.Cost))
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"api_key": newKey,
-		"credits": 1000,
-		"message": "Customer created successfully",
+		"job_id":   job.ID,
+		"status":   db.JobCancelled,
+		"charged":  job.Cost,
+		"released": job.Reserved,
 	})
 }
 
@@ -393,8 +865,29 @@ func main() {
 	dsn := fmt.Sprintf("host=%s user=gridforce password=secret dbname=gridforce_core port=5432 sslmode=disable", dbHost)
 	db.InitDB(dsn)
 
+	// Requeue jobs left in flight by a previous run before dispatching new work
+	requeued, err := db.RecoverJobs()
+	if err != nil {
+		log.Printf("Warning: Failed to recover jobs: %v\n", err)
+	} else if requeued > 0 {
+		log.Printf("Recovered jobs: %d requeued\n", requeued)
+	}
+	loadHeartbeatConfig()
+	loadOfferConfig()
+	loadFramingConfig()
+	loadBillingConfig()
+	loadDispatchConfig()
+	loadAdminConfig()
+	settleUnsettledJobs()
+
+	// Scheduler Configuration
+	sched, err = scheduler.New(os.Getenv("SCHEDULER_POLICY"))
+	if err != nil {
+		log.Fatal("Invalid SCHEDULER_POLICY:", err)
+	}
+	go runDispatcher()
+
 	// Blockchain Configuration
-	var err error
 	rpcURL := os.Getenv("BLOCKCHAIN_RPC")
 	if rpcURL == "" {
 		rpcURL = "http://127.0.0.1:8545"
@@ -436,14 +929,41 @@ func main() {
 	// Download Center
 	http.Handle("/downloads/", http.StripPrefix("/downloads/", http.FileServer(http.Dir("./downloads"))))
 
-	// API Endpoints
-	http.HandleFunc("/ws", handleWebSocket)
-	// Apply Auth Middleware to job dispatch
-	http.HandleFunc("/jobs", authMiddleware(handleJobDispatch))
-	http.HandleFunc("/api/nodes", handleGetNodes)
-	http.HandleFunc("/api/jobs", handleGetJobs)
-	// Admin API
-	http.HandleFunc("/api/admin/create-customer", handleCreateCustomer)
+	// API Endpoints; each is registered with the role it requires
+	registerRoutes(http.DefaultServeMux, []route{
+		// Providers authenticate on the socket itself
+		{"/ws", rolePublic, "", handleWebSocket},
+		// Jobs are paid for by a hold at submit, settled against metered usage
+		{"/jobs", roleCustomer, db.ScopeJobsWrite, handleJobDispatch},
+		{"GET /api/jobs/{id}", roleCustomer, db.ScopeJobsRead, handleGetJob},
+		{"GET /api/jobs/{id}/logs", roleCustomer, db.ScopeJobsRead, handleJobLogs},
+		{"DELETE /api/jobs/{id}", roleCustomer, db.ScopeJobsWrite, handleCancelJob},
+		{"GET /api/ledger", roleCustomer, db.ScopeBillingRead, handleGetLedger},
+		// Customer Account
+		{"GET /api/account", roleCustomer, "", handleGetAccount},
+		{"GET /api/keys", roleCustomer, db.ScopeKeysManage, handleListKeys},
+		{"POST /api/keys", roleCustomer, db.ScopeKeysManage, handleCreateKey},
+		{"POST /api/keys/{id}/rotate", roleCustomer, db.ScopeKeysManage, handleRotateKey},
+		{"DELETE /api/keys/{id}", roleCustomer, db.ScopeKeysManage, handleRevokeKey},
+		// Operations: provider wallets, IPs and other customers' outputs
+		{"/api/nodes", roleOperator, "", handleGetNodes},
+		{"GET /api/nodes/{id}/offers", roleOperator, "", handleGetNodeOffers},
+		{"/api/jobs", roleOperator, "", handleGetJobs},
+		{"POST /api/admin/nodes/{id}/ban", roleOperator, "", handleBanNode},
+		{"POST /api/admin/benchmarks", roleOperator, "", handleRunBenchmark},
+		{"DELETE /api/admin/nodes/{id}/ban", roleOperator, "", handleUnbanNode},
+		// Admin API
+		{"POST /api/admin/customers", roleAdmin, "", handleCreateCustomer},
+		{"GET /api/admin/customers", roleAdmin, "", handleListCustomers},
+		{"GET /api/admin/customers/{id}", roleAdmin, "", handleGetCustomer},
+		{"POST /api/admin/customers/{id}/credits", roleAdmin, "", handleGrantCredits},
+		{"POST /api/admin/customers/{id}/suspend", roleAdmin, "", handleSuspendCustomer},
+		{"DELETE /api/admin/customers/{id}/suspend", roleAdmin, "", handleReinstateCustomer},
+		{"GET /api/admin/tokens", roleAdmin, "", handleListAdminTokens},
+		{"POST /api/admin/tokens", roleAdmin, "", handleCreateAdminToken},
+		{"DELETE /api/admin/tokens/{id}", roleAdmin, "", handleRevokeAdminToken},
+		{"GET /api/admin/audit", roleAdmin, "", handleGetAudit},
+	})
 
 	fmt.Println("Orchestrator running on :8080")
 	if err := http.ListenAndServe(":8080", nil); err != nil {
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gridforce/core/internal/core/db"
+	"github.com/gridforce/core/pkg/protocol"
+)
+
+var (
+	// How long a provider has to accept or reject a job offer
+	offerTimeout = 10 * time.Second
+	// How long a node that declined a job is passed over for it. Busy nodes are retried
+	// sooner; other reasons come from the node's configuration and rarely change.
+	busyRetryDelay = 30 * time.Second
+	declineTTL     = time.Hour
+)
+
+// loadOfferConfig reads OFFER_TIMEOUT (seconds) from the environment
+func loadOfferConfig() {
+	if v := os.Getenv("OFFER_TIMEOUT"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err != nil || secs < 1 {
+			log.Fatal("Invalid OFFER_TIMEOUT: ", v)
+		}
+		offerTimeout = time.Duration(secs) * time.Second
+	}
+}
+
+// declineSet remembers which nodes declined which jobs, so the dispatcher offers a job to
+// the next candidate instead of the node that just turned it down
+type declineSet struct {
+	mu    sync.Mutex
+	until map[string]map[string]time.Time // job ID -> node ID -> end of exclusion
+}
+
+var declines = &declineSet{until: make(map[string]map[string]time.Time)}
+
+// add excludes a node from a job for a time depending on why it declined
+func (d *declineSet) add(jobID, nodeID, reason string) {
+	ttl := declineTTL
+	if reason == protocol.RejectBusy || reason == protocol.RejectTimeout {
+		ttl = busyRetryDelay
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.until[jobID] == nil {
+		d.until[jobID] = make(map[string]time.Time)
+	}
+	d.until[jobID][nodeID] = time.Now().Add(ttl)
+}
+
+// excluded lists the nodes a job should not be offered to right now
+func (d *declineSet) excluded(jobID string) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	var nodes []string
+	for nodeID, until := range d.until[jobID] {
+		if now.Before(until) {
+			nodes = append(nodes, nodeID)
+		}
+	}
+	return nodes
+}
+
+// prune drops expired exclusions, and with them the entries of finished jobs
+func (d *declineSet) prune() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	for jobID, nodes := range d.until {
+		for nodeID, until := range nodes {
+			if !now.Before(until) {
+				delete(nodes, nodeID)
+			}
+		}
+		if len(nodes) == 0 {
+			delete(d.until, jobID)
+		}
+	}
+}
+
+// expireOffer treats an offer the provider did not answer within offerTimeout as rejected
+func expireOffer(sess *ProviderSession, jobID, offerID string) {
+	mu.Lock()
+	a, ok := sess.Jobs[jobID]
+	pending := ok && a.OfferID == offerID && a.OfferTimer != nil
+	if pending {
+		delete(sess.Jobs, jobID)
+	}
+	mu.Unlock()
+	if !pending {
+		return
+	}
+	log.Printf("Offer for job %s to %s timed out after %s\n", jobID, sess.DeviceID, offerTimeout)
+	declineOffer(sess, jobID, protocol.RejectTimeout, "no answer within "+offerTimeout.String())
+}
+
+// handleJobAccept confirms a job the provider agreed to run
+func handleJobAccept(sess *ProviderSession, msg protocol.Message, accept protocol.JobAcceptPayload) {
+	mu.Lock()
+	a, ok := sess.Jobs[accept.JobID]
+	answered := ok && a.OfferID == msg.ReplyTo && a.OfferTimer != nil
+	if answered {
+		a.OfferTimer.Stop()
+		a.OfferTimer = nil
+		sess.OffersAccepted++
+	}
+	mu.Unlock()
+
+	if !answered {
+		// The offer already timed out and the job went back to the queue; stop the copy
+		log.Printf("Late accept for job %s from %s, cancelling it there\n", accept.JobID, sess.DeviceID)
+		if sess.supports(protocol.FeatureJobCancel) {
+			if err := sess.send(protocol.JobCancelPayload{JobID: accept.JobID}); err != nil {
+				log.Printf("Failed to send cancel for job %s to %s: %v\n", accept.JobID, sess.DeviceID, err)
+			}
+		}
+		return
+	}
+
+	log.Printf("Job %s accepted by %s\n", accept.JobID, sess.DeviceID)
+	if err := db.RecordOfferAccepted(sess.DeviceID); err != nil {
+		log.Printf("Failed to record accepted offer of %s: %v\n", sess.DeviceID, err)
+	}
+}
+
+// handleJobReject gives a job the provider declined to the next candidate
+func handleJobReject(sess *ProviderSession, msg protocol.Message, reject protocol.JobRejectPayload) {
+	mu.Lock()
+	a, ok := sess.Jobs[reject.JobID]
+	answered := ok && a.OfferID == msg.ReplyTo && a.OfferTimer != nil
+	if answered {
+		a.OfferTimer.Stop()
+		delete(sess.Jobs, reject.JobID)
+	}
+	mu.Unlock()
+
+	if !answered {
+		log.Printf("Ignoring reject for job %s from %s: no pending offer\n", reject.JobID, sess.DeviceID)
+		return
+	}
+	log.Printf("Job %s rejected by %s (%s): %s\n", reject.JobID, sess.DeviceID, reject.Reason, reject.Message)
+	declineOffer(sess, reject.JobID, reject.Reason, reject.Message)
+}
+
+// handleOfferError treats an ERROR reply to an unanswered offer as a rejection of the job.
+// Errors about offers that were already answered or timed out are only logged.
+func handleOfferError(sess *ProviderSession, msg protocol.Message, providerErr protocol.ErrorPayload) {
+	jobID := takeFailedOffer(sess, msg.ReplyTo)
+	if jobID == "" {
+		return
+	}
+	log.Printf("Offer for job %s failed on %s, treating it as rejected\n", jobID, sess.DeviceID)
+	declineOffer(sess, jobID, providerErr.Code, providerErr.Message)
+}
+
+// takeFailedOffer removes the job an ERROR reply is about from the session and returns it.
+// Offers to providers that negotiated offers count while their timer runs, i.e. until
+// accepted; other providers answer an offer only with ACK or ERROR, so it has no timer.
+func takeFailedOffer(sess *ProviderSession, offerID string) string {
+	if offerID == "" {
+		return ""
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for jobID, a := range sess.Jobs {
+		if a.OfferID != offerID {
+			continue
+		}
+		if a.OfferTimer == nil && sess.supports(protocol.FeatureOffers) {
+			return "" // already accepted
+		}
+		if a.OfferTimer != nil {
+			a.OfferTimer.Stop()
+		}
+		delete(sess.Jobs, jobID)
+		return jobID
+	}
+	return ""
+}
+
+// declineOffer records a declined offer and puts the job back in the queue, passing over
+// the node that declined it
+func declineOffer(sess *ProviderSession, jobID, reason, message string) {
+	declines.add(jobID, sess.DeviceID, reason)
+
+	mu.Lock()
+	sess.OffersRejected++
+	mu.Unlock()
+	if err := db.RecordOfferRejected(sess.DeviceID, jobID, reason, message); err != nil {
+		log.Printf("Failed to record rejected offer of %s: %v\n", sess.DeviceID, err)
+	}
+
+	if _, err := db.RequeueJobs(sess.DeviceID, []string{jobID}, false); err != nil {
+		log.Printf("Job %s could not be requeued: %v\n", jobID, err)
+	}
+	wakeDispatcher()
+}
+
+// API: Get a node's answers to job offers
+func handleGetNodeOffers(w http.ResponseWriter, r *http.Request) {
+	var node db.Node
+	if err := db.DB.First(&node, "id = ?", r.PathValue("id")).Error; err != nil {
+		http.Error(w, "Node not found", http.StatusNotFound)
+		return
+	}
+	rejections, err := db.OfferRejectionStats(node.ID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"node_id":    node.ID,
+		"accepted":   node.OffersAccepted,
+		"rejected":   node.OffersRejected,
+		"rejections": rejections,
+	})
+}
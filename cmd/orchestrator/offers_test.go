@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gridforce/core/pkg/protocol"
+)
+
+func TestTakeFailedOffer(t *testing.T) {
+	acks := []string{protocol.FeatureAcks}
+	offers := []string{protocol.FeatureAcks, protocol.FeatureOffers}
+
+	t.Run("no timer without offers", func(t *testing.T) {
+		sess := &ProviderSession{Features: acks, Jobs: map[string]*assignment{
+			"job-1": {OfferID: "offer-1"},
+			"job-2": {OfferID: "offer-2"},
+		}}
+		if got := takeFailedOffer(sess, "offer-1"); got != "job-1" {
+			t.Fatalf("takeFailedOffer = %q, want job-1", got)
+		}
+		if _, ok := sess.Jobs["job-1"]; ok {
+			t.Fatal("failed offer left on the session")
+		}
+		if _, ok := sess.Jobs["job-2"]; !ok {
+			t.Fatal("other job removed from the session")
+		}
+	})
+
+	t.Run("pending offer", func(t *testing.T) {
+		fired := make(chan struct{})
+		timer := time.AfterFunc(time.Hour, func() { close(fired) })
+		sess := &ProviderSession{Features: offers, Jobs: map[string]*assignment{
+			"job-1": {OfferID: "offer-1", OfferTimer: timer},
+		}}
+		if got := takeFailedOffer(sess, "offer-1"); got != "job-1" {
+			t.Fatalf("takeFailedOffer = %q, want job-1", got)
+		}
+		if timer.Stop() {
+			t.Fatal("offer timer still running")
+		}
+	})
+
+	t.Run("accepted offer", func(t *testing.T) {
+		sess := &ProviderSession{Features: offers, Jobs: map[string]*assignment{
+			"job-1": {OfferID: "offer-1"},
+		}}
+		if got := takeFailedOffer(sess, "offer-1"); got != "" {
+			t.Fatalf("takeFailedOffer = %q for an accepted offer", got)
+		}
+		if _, ok := sess.Jobs["job-1"]; !ok {
+			t.Fatal("accepted job removed from the session")
+		}
+	})
+
+	t.Run("unknown offer", func(t *testing.T) {
+		sess := &ProviderSession{Features: acks, Jobs: map[string]*assignment{
+			"job-1": {OfferID: "offer-1"},
+		}}
+		for _, id := range []string{"offer-9", ""} {
+			if got := takeFailedOffer(sess, id); got != "" {
+				t.Fatalf("takeFailedOffer(%q) = %q, want none", id, got)
+			}
+		}
+	})
+}
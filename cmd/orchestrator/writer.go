@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/gridforce/core/pkg/protocol"
+)
+
+const (
+	// Messages queued for a provider before senders start waiting
+	sendQueueSize = 256
+	// How long a sender waits on a full queue before the provider is dropped as too slow
+	sendQueueTimeout = 5 * time.Second
+	// How long a single message or ping may take to be written
+	writeWait = 10 * time.Second
+)
+
+var (
+	// errSessionClosed is returned when sending to a provider that has disconnected
+	errSessionClosed = errors.New("provider session closed")
+	// errSendQueueFull is returned when a provider does not read its messages fast enough
+	errSendQueueFull = errors.New("provider send queue full")
+)
+
+// newProviderSession creates the session of a new connection and starts its writer
+func newProviderSession(conn *websocket.Conn, addr string) *ProviderSession {
+	s := &ProviderSession{
+		Conn:     conn,
+		IP:       addr,
+		Status:   "CONNECTED",
+		LastSeen: time.Now(),
+		Jobs:     make(map[string]*assignment),
+		blobs:    protocol.NewAssembler(maxBlobBuffer),
+		outbound: make(chan protocol.Message, sendQueueSize),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go s.writeLoop()
+	return s
+}
+
+// writeLoop is the only goroutine writing to the connection: it sends queued messages and
+// pings the provider every heartbeat interval until the session is closed, then flushes
+// what is still queued. A failed write closes the connection, which ends the read loop.
+func (s *ProviderSession) writeLoop() {
+	defer close(s.stopped)
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			for {
+				select {
+				case msg := <-s.outbound:
+					if s.writeMessage(msg) != nil {
+						return
+					}
+				default:
+					return
+				}
+			}
+		case msg := <-s.outbound:
+			if s.writeMessage(msg) != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := s.Conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				log.Printf("Ping to %s failed: %v\n", s.IP, err)
+				s.Conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// writeMessage writes one message within writeWait, closing the connection on failure
+func (s *ProviderSession) writeMessage(msg protocol.Message) error {
+	s.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+	err := s.Conn.WriteJSON(msg)
+	if err != nil {
+		log.Printf("Write of %s to %s failed: %v\n", msg.Type, s.IP, err)
+		s.Conn.Close()
+	}
+	return err
+}
+
+// write queues a message for the provider. When the queue is full the sender waits up to
+// sendQueueTimeout; a provider that still has not caught up is disconnected.
+func (s *ProviderSession) write(msg protocol.Message) error {
+	select {
+	case s.outbound <- msg:
+		return nil
+	case <-s.done:
+		return errSessionClosed
+	default:
+	}
+
+	timer := time.NewTimer(sendQueueTimeout)
+	defer timer.Stop()
+	select {
+	case s.outbound <- msg:
+		return nil
+	case <-s.done:
+		return errSessionClosed
+	case <-timer.C:
+		log.Printf("Provider %s is not keeping up with its messages, disconnecting\n", s.IP)
+		s.Conn.Close()
+		return errSendQueueFull
+	}
+}
+
+// close stops accepting messages and waits for the writer to flush the queue, so replies
+// such as an AUTH rejection reach the provider before the connection is closed
+func (s *ProviderSession) close() {
+	s.closeOnce.Do(func() { close(s.done) })
+	<-s.stopped
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Reconnect delays: doubling from reconnectMinDelay up to reconnectMaxDelay
+const (
+	reconnectMinDelay = time.Second
+	reconnectMaxDelay = time.Minute
+)
+
+// backoff produces jittered exponential reconnect delays, so providers cut off together do
+// not all reconnect at the same moment
+type backoff struct {
+	min, max time.Duration
+	current  time.Duration
+}
+
+// next returns the delay before the next attempt: a random point in the upper half of the
+// current window, which doubles on every call
+func (b *backoff) next() time.Duration {
+	if b.current == 0 {
+		b.current = b.min
+	} else if b.current *= 2; b.current > b.max {
+		b.current = b.max
+	}
+	half := b.current / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// reset starts over from the minimum delay after a successful connection
+func (b *backoff) reset() {
+	b.current = 0
+}
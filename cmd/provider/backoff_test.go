@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffBounds(t *testing.T) {
+	for run := 0; run < 100; run++ {
+		b := &backoff{min: reconnectMinDelay, max: reconnectMaxDelay}
+		window := reconnectMinDelay
+		var previous time.Duration
+		for attempt := 0; attempt < 12; attempt++ {
+			d := b.next()
+			if d < window/2 || d > window {
+				t.Fatalf("attempt %d: delay %s outside [%s, %s]", attempt, d, window/2, window)
+			}
+			if d > reconnectMaxDelay {
+				t.Fatalf("attempt %d: delay %s exceeds the max %s", attempt, d, reconnectMaxDelay)
+			}
+			// While the window doubles, it starts where the previous one ended, so delays
+			// never shrink
+			if window < reconnectMaxDelay && d < previous {
+				t.Fatalf("attempt %d: delay %s shorter than the previous %s", attempt, d, previous)
+			}
+			previous = d
+			if window *= 2; window > reconnectMaxDelay {
+				window = reconnectMaxDelay
+			}
+		}
+	}
+}
+
+func TestBackoffReset(t *testing.T) {
+	b := &backoff{min: reconnectMinDelay, max: reconnectMaxDelay}
+	for i := 0; i < 10; i++ {
+		b.next()
+	}
+	if d := b.next(); d < reconnectMaxDelay/2 {
+		t.Fatalf("delay %s after 10 attempts, want at least %s", d, reconnectMaxDelay/2)
+	}
+
+	b.reset()
+	if d := b.next(); d < reconnectMinDelay/2 || d > reconnectMinDelay {
+		t.Fatalf("delay %s after reset, want within [%s, %s]", d, reconnectMinDelay/2, reconnectMinDelay)
+	}
+}
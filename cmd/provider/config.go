@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/gridforce/core/internal/platform/container"
+	"github.com/gridforce/core/pkg/protocol"
+)
+
+// Prefix of the environment variables that override the config file, e.g.
+// GRIDFORCE_SERVER for -server or GRIDFORCE_MAX_MEMORY_MB for -max-memory-mb
+const envPrefix = "GRIDFORCE_"
+
+// Name of the config file looked up in the data dir when -config is not given
+const configFileName = "provider.json"
+
+// Config is the provider's configuration. Values come from, in increasing precedence:
+// defaults, the JSON config file, GRIDFORCE_* environment variables and command-line flags.
+type Config struct {
+	Wallet               string `json:"wallet"`
+	KeyFile              string `json:"key_file"`
+	Keystore             string `json:"keystore"`
+	KeystorePasswordFile string `json:"keystore_password_file"`
+
+	Server            string   `json:"server"`
+	DataDir           string   `json:"data_dir"`
+	HeartbeatInterval duration `json:"heartbeat_interval"`
+	Slots             int      `json:"slots"`
+	MaxMessageSize    int64    `json:"max_message_size"`
+
+	// Sandbox relaxations and hardening
+	AllowNetwork        bool   `json:"allow_network"`
+	AllowWritableRootfs bool   `json:"allow_writable_rootfs"`
+	AllowRoot           bool   `json:"allow_root"`
+	SeccompProfile      string `json:"seccomp_profile"`
+
+	// Per-job resource caps; zero means uncapped
+	MaxCPUs     float64  `json:"max_cpus"`
+	MaxMemoryMB int64    `json:"max_memory_mb"`
+	MaxShmMB    int64    `json:"max_shm_mb"`
+	MaxPids     int64    `json:"max_pids"`
+	MaxTimeout  duration `json:"max_timeout"`
+
+	AllowedRegistries stringList `json:"allowed_registries"`
+
+	// Prices charged for the provider's resources, in credits per hour; all zero means the
+	// orchestrator's default prices
+	PriceCoreHour     float64 `json:"price_core_hour"`
+	PriceMemoryGBHour float64 `json:"price_memory_gb_hour"`
+	PriceWallHour     float64 `json:"price_wall_hour"`
+}
+
+// duration is a time.Duration written as "30s" in the config file and on the command line
+type duration time.Duration
+
+func (d *duration) String() string { return time.Duration(*d).String() }
+
+func (d *duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %v", err)
+	}
+	return d.Set(s)
+}
+
+// stringList is a list given as a JSON array in the config file and comma-separated elsewhere
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(s string) error {
+	*l = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// defaultConfig returns the configuration used when nothing is set
+func defaultConfig() Config {
+	return Config{
+		DataDir:           defaultDataDir(),
+		HeartbeatInterval: duration(10 * time.Second),
+		Slots:             defaultSlots(),
+		MaxMessageSize:    1 << 20,
+	}
+}
+
+// defaultDataDir returns the per-user directory the provider keeps its state in
+func defaultDataDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ".gridforce"
+	}
+	return filepath.Join(dir, "gridforce")
+}
+
+// flagSet binds every option to a field of c; the flags' defaults are c's current values
+func (c *Config) flagSet(configFile *string) *flag.FlagSet {
+	fs := flag.NewFlagSet("provider", flag.ContinueOnError)
+	fs.StringVar(configFile, "config", *configFile, "Path to a JSON config file (default: <data-dir>/"+configFileName+" if it exists)")
+
+	fs.StringVar(&c.Wallet, "wallet", c.Wallet, "Wallet address (EIP-55); must match the signing key, derived from it if empty")
+	fs.StringVar(&c.KeyFile, "key-file", c.KeyFile, "Path to a file holding the wallet's hex private key")
+	fs.StringVar(&c.Keystore, "keystore", c.Keystore, "Path to an encrypted keystore file holding the wallet key")
+	fs.StringVar(&c.KeystorePasswordFile, "keystore-password-file", c.KeystorePasswordFile, "Path to the keystore password (default: $"+keystorePasswordEnv+")")
+
+	fs.StringVar(&c.Server, "server", c.Server, "Orchestrator URL, e.g. wss://orchestrator.example.com or ws://localhost:8080")
+	fs.StringVar(&c.DataDir, "data-dir", c.DataDir, "Directory holding the provider's device identity and state")
+	fs.Var(&c.HeartbeatInterval, "heartbeat-interval", "How often to send heartbeats to the orchestrator")
+	fs.IntVar(&c.Slots, "slots", c.Slots, "Number of jobs to run concurrently, derived from CPU cores by default")
+	fs.Int64Var(&c.MaxMessageSize, "max-message-size", c.MaxMessageSize, "Largest message in bytes accepted from the orchestrator")
+
+	fs.BoolVar(&c.AllowNetwork, "allow-network", c.AllowNetwork, "Accept jobs that need network egress")
+	fs.BoolVar(&c.AllowWritableRootfs, "allow-writable-rootfs", c.AllowWritableRootfs, "Accept jobs that need a writable root filesystem")
+	fs.BoolVar(&c.AllowRoot, "allow-root", c.AllowRoot, "Accept jobs that need to run as root inside the container")
+	fs.StringVar(&c.SeccompProfile, "seccomp-profile", c.SeccompProfile, "Path to a seccomp JSON profile applied to every job (default: Docker's profile)")
+
+	fs.Float64Var(&c.MaxCPUs, "max-cpus", c.MaxCPUs, "Most CPUs a single job may use (0: uncapped)")
+	fs.Int64Var(&c.MaxMemoryMB, "max-memory-mb", c.MaxMemoryMB, "Most memory in MB a single job may use (0: uncapped)")
+	fs.Int64Var(&c.MaxShmMB, "max-shm-mb", c.MaxShmMB, "Most shared memory (/dev/shm) in MB a single job may use (0: uncapped)")
+	fs.Int64Var(&c.MaxPids, "max-pids", c.MaxPids, "Most processes a single job may run (0: uncapped)")
+	fs.Var(&c.MaxTimeout, "max-timeout", "Longest a single job may run (0: uncapped)")
+
+	fs.Var(&c.AllowedRegistries, "allowed-registries", "Comma-separated registries images may be pulled from, e.g. docker.io,ghcr.io (default: any)")
+
+	fs.Float64Var(&c.PriceCoreHour, "price-core-hour", c.PriceCoreHour, "Credits charged per core-hour of CPU time (all prices 0: orchestrator default)")
+	fs.Float64Var(&c.PriceMemoryGBHour, "price-memory-gb-hour", c.PriceMemoryGBHour, "Credits charged per GB-hour of memory")
+	fs.Float64Var(&c.PriceWallHour, "price-wall-hour", c.PriceWallHour, "Credits charged per hour of wall time")
+	return fs
+}
+
+// envName returns the environment variable overriding a flag
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// loadConfig builds the configuration from defaults, config file, environment and arguments
+func loadConfig(args []string) (*Config, error) {
+	// A first pass over the arguments only finds the config file
+	var configFile string
+	probe := defaultConfig()
+	probeFlags := probe.flagSet(&configFile)
+	probeFlags.SetOutput(io.Discard)
+	probeFlags.Usage = func() {}
+	if err := probeFlags.Parse(args); err != nil && !errors.Is(err, flag.ErrHelp) {
+		return nil, err
+	}
+	if configFile == "" {
+		configFile = os.Getenv(envName("config"))
+	}
+	required := configFile != ""
+	if configFile == "" {
+		dataDir := probe.DataDir
+		if v := os.Getenv(envName("data-dir")); v != "" && !isFlagSet(probeFlags, "data-dir") {
+			dataDir = v
+		}
+		configFile = filepath.Join(dataDir, configFileName)
+	}
+
+	cfg := defaultConfig()
+	data, err := os.ReadFile(configFile)
+	switch {
+	case err == nil:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %v", configFile, err)
+		}
+	case required || !errors.Is(err, os.ErrNotExist):
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	default:
+		configFile = ""
+	}
+
+	// Environment overrides the file, flags override both
+	fs := cfg.flagSet(&configFile)
+	var envErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		if v, ok := os.LookupEnv(envName(f.Name)); ok && f.Name != "config" && envErr == nil {
+			if err := fs.Set(f.Name, v); err != nil {
+				envErr = fmt.Errorf("invalid %s: %v", envName(f.Name), err)
+			}
+		}
+	})
+	if envErr != nil {
+		return nil, envErr
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// isFlagSet reports whether a flag was given on the command line
+func isFlagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// validate checks the configuration and normalizes the server URL and wallet address
+func (c *Config) validate() error {
+	if c.Wallet != "" {
+		wallet, err := checksumAddress(c.Wallet)
+		if err != nil {
+			return err
+		}
+		c.Wallet = wallet
+	}
+	if c.KeyFile == "" && c.Keystore == "" {
+		return errors.New("no wallet key configured (set key-file or keystore)")
+	}
+	if c.KeyFile != "" && c.Keystore != "" {
+		return errors.New("set either key-file or keystore, not both")
+	}
+
+	if c.Server == "" {
+		return errors.New("server is required, e.g. wss://orchestrator.example.com")
+	}
+	u, err := url.Parse(c.Server)
+	if err != nil {
+		return fmt.Errorf("invalid server URL: %v", err)
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return fmt.Errorf("server URL must use ws:// or wss://, got %q", c.Server)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("server URL %q has no host", c.Server)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/ws"
+	}
+	c.Server = u.String()
+
+	if c.DataDir == "" {
+		return errors.New("data-dir must not be empty")
+	}
+	if c.Slots < 1 {
+		return errors.New("slots must be at least 1")
+	}
+	if c.HeartbeatInterval <= 0 {
+		return errors.New("heartbeat-interval must be positive")
+	}
+	if c.MaxMessageSize < 64<<10 {
+		return errors.New("max-message-size must be at least 65536")
+	}
+	if c.MaxCPUs < 0 || c.MaxMemoryMB < 0 || c.MaxShmMB < 0 || c.MaxPids < 0 || c.MaxTimeout < 0 {
+		return errors.New("resource caps must not be negative")
+	}
+	if c.PriceCoreHour < 0 || c.PriceMemoryGBHour < 0 || c.PriceWallHour < 0 {
+		return errors.New("prices must not be negative")
+	}
+	return nil
+}
+
+// checksumAddress validates a wallet address and returns it in EIP-55 form. Mixed-case
+// addresses must carry a correct checksum; all-lower or all-upper ones carry none.
+func checksumAddress(address string) (string, error) {
+	if !common.IsHexAddress(address) {
+		return "", fmt.Errorf("invalid wallet address %q", address)
+	}
+	checksummed := common.HexToAddress(address).Hex()
+	hexPart := strings.TrimPrefix(strings.TrimPrefix(address, "0x"), "0X")
+	if hexPart != strings.ToLower(hexPart) && hexPart != strings.ToUpper(hexPart) && "0x"+hexPart != checksummed {
+		return "", fmt.Errorf("wallet address %q has an invalid EIP-55 checksum", address)
+	}
+	return checksummed, nil
+}
+
+// policy builds the sandbox policy jobs are checked against
+func (c *Config) policy() (container.Policy, error) {
+	policy := container.Policy{
+		Allow: container.Sandbox{
+			Network:        c.AllowNetwork,
+			WritableRootfs: c.AllowWritableRootfs,
+			RunAsRoot:      c.AllowRoot,
+		},
+		MaxLimits: container.Limits{
+			CPUs:         c.MaxCPUs,
+			MemoryBytes:  c.MaxMemoryMB * 1024 * 1024,
+			ShmSizeBytes: c.MaxShmMB * 1024 * 1024,
+			PidsLimit:    c.MaxPids,
+			Timeout:      time.Duration(c.MaxTimeout),
+		},
+		AllowedRegistries: c.AllowedRegistries,
+	}
+	if c.SeccompProfile != "" {
+		if err := policy.LoadSeccompProfile(c.SeccompProfile); err != nil {
+			return policy, err
+		}
+	}
+	return policy, nil
+}
+
+// prices returns the prices advertised to the orchestrator
+func (c *Config) prices() protocol.Prices {
+	return protocol.Prices{CoreHour: c.PriceCoreHour, MemoryGBHour: c.PriceMemoryGBHour, WallHour: c.PriceWallHour}
+}
+
+// print writes the effective configuration to stdout
+func (c *Config) print() {
+	uncapped := func(set bool, v string) string {
+		if !set {
+			return "uncapped"
+		}
+		return v
+	}
+	registries := "any"
+	if len(c.AllowedRegistries) > 0 {
+		registries = c.AllowedRegistries.String()
+	}
+	keySource := "key file " + c.KeyFile
+	if c.Keystore != "" {
+		keySource = "keystore " + c.Keystore
+	}
+
+	fmt.Println("Provider configuration:")
+	fmt.Printf("  Server:             %s\n", c.Server)
+	fmt.Printf("  Wallet key:         %s\n", keySource)
+	fmt.Printf("  Data dir:           %s\n", c.DataDir)
+	fmt.Printf("  Slots:              %d\n", c.Slots)
+	fmt.Printf("  Heartbeat interval: %s\n", c.HeartbeatInterval.String())
+	fmt.Printf("  Max message size:   %d bytes\n", c.MaxMessageSize)
+	fmt.Printf("  Sandbox:            network=%t writable-rootfs=%t root=%t\n", c.AllowNetwork, c.AllowWritableRootfs, c.AllowRoot)
+	if c.SeccompProfile != "" {
+		fmt.Printf("  Seccomp profile:    %s\n", c.SeccompProfile)
+	}
+	fmt.Printf("  Max CPUs:           %s\n", uncapped(c.MaxCPUs > 0, fmt.Sprintf("%g", c.MaxCPUs)))
+	fmt.Printf("  Max memory:         %s\n", uncapped(c.MaxMemoryMB > 0, fmt.Sprintf("%d MB", c.MaxMemoryMB)))
+	fmt.Printf("  Max shared memory:  %s\n", uncapped(c.MaxShmMB > 0, fmt.Sprintf("%d MB", c.MaxShmMB)))
+	fmt.Printf("  Max processes:      %s\n", uncapped(c.MaxPids > 0, fmt.Sprintf("%d", c.MaxPids)))
+	fmt.Printf("  Max job timeout:    %s\n", uncapped(c.MaxTimeout > 0, c.MaxTimeout.String()))
+	if c.prices() == (protocol.Prices{}) {
+		fmt.Println("  Prices:             orchestrator default")
+	} else {
+		fmt.Printf("  Prices:             %g/core-hour %g/GB-hour %g/hour\n", c.PriceCoreHour, c.PriceMemoryGBHour, c.PriceWallHour)
+	}
+	fmt.Printf("  Allowed registries: %s\n", registries)
+}
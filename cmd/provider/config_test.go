@@ -0,0 +1,141 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeConfigFile writes a provider.json into dir
+func writeConfigFile(t *testing.T, dir, contents string) string {
+	t.Helper()
+	path := filepath.Join(dir, configFileName)
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("write config file: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	writeConfigFile(t, dir, `{
+		"server": "ws://file.example.com",
+		"key_file": "/keys/file.key",
+		"slots": 2,
+		"max_memory_mb": 512,
+		"heartbeat_interval": "20s",
+		"allowed_registries": ["docker.io"]
+	}`)
+	t.Setenv("GRIDFORCE_DATA_DIR", dir)
+	t.Setenv("GRIDFORCE_SERVER", "wss://env.example.com")
+	t.Setenv("GRIDFORCE_SLOTS", "3")
+	t.Setenv("GRIDFORCE_ALLOWED_REGISTRIES", "docker.io, ghcr.io")
+
+	cfg, err := loadConfig([]string{"-slots", "4"})
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if cfg.Server != "wss://env.example.com/ws" {
+		t.Errorf("Server = %q, want the environment's, with the default path", cfg.Server)
+	}
+	if cfg.Slots != 4 {
+		t.Errorf("Slots = %d, want the flag's 4", cfg.Slots)
+	}
+	if cfg.KeyFile != "/keys/file.key" || cfg.MaxMemoryMB != 512 {
+		t.Errorf("KeyFile = %q, MaxMemoryMB = %d; want the file's values", cfg.KeyFile, cfg.MaxMemoryMB)
+	}
+	if time.Duration(cfg.HeartbeatInterval) != 20*time.Second {
+		t.Errorf("HeartbeatInterval = %s, want 20s", cfg.HeartbeatInterval.String())
+	}
+	if got := cfg.AllowedRegistries.String(); got != "docker.io,ghcr.io" {
+		t.Errorf("AllowedRegistries = %q, want the environment's", got)
+	}
+	if cfg.MaxMessageSize != defaultConfig().MaxMessageSize {
+		t.Errorf("MaxMessageSize = %d, want the default", cfg.MaxMessageSize)
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("GRIDFORCE_DATA_DIR", dir)
+
+	// The file named by -config is required, the one in the data dir is not
+	if _, err := loadConfig([]string{"-config", filepath.Join(dir, "missing.json"), "-server", "ws://localhost:8080", "-key-file", "k"}); err == nil {
+		t.Error("missing -config file accepted")
+	}
+	if _, err := loadConfig([]string{"-server", "ws://localhost:8080", "-key-file", "k"}); err != nil {
+		t.Errorf("loadConfig without a config file: %v", err)
+	}
+
+	writeConfigFile(t, dir, `{"server": "ws://localhost:8080", "key_file": "k", "slotz": 2}`)
+	if _, err := loadConfig(nil); err == nil {
+		t.Error("config file with an unknown field accepted")
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	t.Setenv("GRIDFORCE_DATA_DIR", t.TempDir())
+	base := []string{"-server", "ws://localhost:8080", "-key-file", "k"}
+
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"no server", []string{"-key-file", "k"}},
+		{"http server", []string{"-server", "http://localhost:8080", "-key-file", "k"}},
+		{"no host", []string{"-server", "ws://", "-key-file", "k"}},
+		{"no key", []string{"-server", "ws://localhost:8080"}},
+		{"key file and keystore", append(base, "-keystore", "ks.json")},
+		{"bad wallet", append(base, "-wallet", "0x1234")},
+		{"zero slots", append(base, "-slots", "0")},
+		{"negative cap", append(base, "-max-shm-mb", "-1")},
+		{"negative price", append(base, "-price-core-hour", "-0.5")},
+		{"small message size", append(base, "-max-message-size", "1024")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := loadConfig(tt.args); err == nil {
+				t.Fatalf("loadConfig(%q) accepted an invalid configuration", tt.args)
+			}
+		})
+	}
+
+	t.Run("invalid environment", func(t *testing.T) {
+		t.Setenv("GRIDFORCE_SLOTS", "many")
+		if _, err := loadConfig(base); err == nil {
+			t.Fatal("invalid GRIDFORCE_SLOTS accepted")
+		}
+	})
+}
+
+func TestChecksumAddress(t *testing.T) {
+	const checksummed = "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed"
+	tests := []struct {
+		address string
+		want    string
+		wantErr bool
+	}{
+		{address: checksummed, want: checksummed},
+		{address: "0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaed", want: checksummed},
+		{address: "0x5AAEB6053F3E94C9B9A09F33669435E7EF1BEAED", want: checksummed},
+		{address: "5aaeb6053f3e94c9b9a09f33669435e7ef1beaed", want: checksummed},
+		{address: "0xfB6916095ca1df60bB79Ce92cE3Ea74c37c5d359", want: "0xfB6916095ca1df60bB79Ce92cE3Ea74c37c5d359"},
+		{address: "0x5AAeb6053F3E94C9b9A09f33669435E7Ef1BeAed", wantErr: true}, // one letter's case flipped
+		{address: "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAe", wantErr: true},  // too short
+		{address: "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAeZ", wantErr: true}, // not hex
+		{address: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := checksumAddress(tt.address)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("checksumAddress(%q) = %q, want an error", tt.address, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("checksumAddress(%q) = %q, %v; want %q", tt.address, got, err, tt.want)
+		}
+	}
+}
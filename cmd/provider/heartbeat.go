@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/gridforce/core/pkg/protocol"
+	"github.com/shirou/gopsutil/load"
+	"github.com/shirou/gopsutil/mem"
+)
+
+// Missed heartbeat intervals after which a silent orchestrator connection is dropped; the
+// orchestrator pings every interval, so a live connection is never silent that long
+const heartbeatMissLimit = 3
+
+// keepAlive drops the connection when nothing, not even a ping, arrives for missLimit
+// heartbeat intervals, so a half-open connection is noticed and the provider reconnects
+func keepAlive(c *websocket.Conn, interval time.Duration) func() {
+	timeout := interval * heartbeatMissLimit
+	extend := func() { c.SetReadDeadline(time.Now().Add(timeout)) }
+	extend()
+	c.SetPingHandler(func(data string) error {
+		extend()
+		err := c.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		return err
+	})
+	return extend
+}
+
+// sendHeartbeats reports liveness and load to the orchestrator every interval until stop is closed
+func sendHeartbeats(out *wsSender, runner *jobRunner, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := out.send(buildHeartbeat(runner)); err != nil {
+				log.Println("write heartbeat:", err)
+				return
+			}
+		}
+	}
+}
+
+// buildHeartbeat collects slot usage and host load; metrics that cannot be read are left at zero
+func buildHeartbeat(runner *jobRunner) protocol.HeartbeatPayload {
+	hb := runner.status()
+	if avg, err := load.Avg(); err == nil {
+		hb.Load1 = avg.Load1
+	}
+	if vm, err := mem.VirtualMemory(); err == nil {
+		hb.MemUsedPercent = vm.UsedPercent
+	}
+	return hb
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Name of the device key file inside the data dir
+const deviceKeyFile = "device.key"
+
+// loadDeviceKey returns the provider's Ed25519 device key, generating and saving one on
+// first start. The hex-encoded public key is the device ID the orchestrator knows it by.
+func loadDeviceKey(dataDir string) (ed25519.PrivateKey, error) {
+	path := filepath.Join(dataDir, deviceKeyFile)
+
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("failed to parse device key %s: no PEM block", path)
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse device key %s: %v", path, err)
+		}
+		key, ok := parsed.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("device key %s is not an Ed25519 key", path)
+		}
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read device key: %v", err)
+	}
+
+	// First start: create the identity
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate device key: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode device key: %v", err)
+	}
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create data dir: %v", err)
+	}
+	if err := saveDeviceKey(path, der); err != nil {
+		return nil, fmt.Errorf("failed to save device key: %v", err)
+	}
+	return key, nil
+}
+
+// saveDeviceKey writes the key to a temporary file and links it into place once complete,
+// so a failed write never leaves a partial key behind. Linking fails if the key exists, so
+// two providers starting at once cannot overwrite each other's identity.
+func saveDeviceKey(path string, der []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), deviceKeyFile+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der}); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Link(f.Name(), path)
+}
+
+// deviceID encodes the public half of a device key
+func deviceID(key ed25519.PrivateKey) string {
+	return hex.EncodeToString(key.Public().(ed25519.PublicKey))
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/gridforce/core/internal/platform/container"
+	"github.com/gridforce/core/pkg/protocol"
+	"github.com/shirou/gopsutil/mem"
+)
+
+// maxQueuedOffers bounds offers waiting for a free slot; the orchestrator respects advertised
+// slots, so this only absorbs offers that cross a capacity update in flight
+const maxQueuedOffers = 64
+
+// queuedJob is an accepted offer waiting for a worker
+type queuedJob struct {
+	ctx   context.Context
+	offer protocol.JobOfferPayload
+}
+
+// jobRunner executes offered jobs on a fixed pool of workers so the read loop keeps serving messages
+type jobRunner struct {
+	out     *wsSender
+	results *outbox
+	policy  container.Policy
+	slots   int
+	queue   chan queuedJob
+
+	mu      sync.Mutex
+	running map[string]context.CancelFunc // queued or running jobs
+	busy    int
+}
+
+// newJobRunner starts one worker per slot
+func newJobRunner(out *wsSender, results *outbox, policy container.Policy, slots int) *jobRunner {
+	r := &jobRunner{
+		out:     out,
+		results: results,
+		policy:  policy,
+		slots:   slots,
+		queue:   make(chan queuedJob, maxQueuedOffers),
+		running: make(map[string]context.CancelFunc),
+	}
+	for i := 0; i < slots; i++ {
+		go r.worker()
+	}
+	return r
+}
+
+// defaultSlots derives the slot count from the machine's cores, leaving room for each job to use two
+func defaultSlots() int {
+	if n := runtime.NumCPU() / 2; n > 1 {
+		return n
+	}
+	return 1
+}
+
+// screen decides whether to take an offered job, returning the rejection to answer with if not
+func (r *jobRunner) screen(offer protocol.JobOfferPayload) *protocol.JobRejectPayload {
+	reject := func(reason, message string) *protocol.JobRejectPayload {
+		return &protocol.JobRejectPayload{JobID: offer.JobID, Reason: reason, Message: message}
+	}
+
+	r.mu.Lock()
+	held := len(r.running)
+	r.mu.Unlock()
+	if held >= r.slots {
+		return reject(protocol.RejectBusy, fmt.Sprintf("all %d slots taken", r.slots))
+	}
+
+	if err := r.policy.CheckImage(offer.Image); err != nil {
+		return reject(protocol.RejectImageNotAllowed, err.Error())
+	}
+	if err := r.policy.Check(offerSandbox(offer)); err != nil {
+		return reject(protocol.RejectPolicy, err.Error())
+	}
+	if _, err := r.policy.Cap(offerLimits(offer)); err != nil {
+		return reject(protocol.RejectInsufficientResources, err.Error())
+	}
+	if cpus := runtime.NumCPU(); offer.Resources.CPUs > float64(cpus) {
+		return reject(protocol.RejectInsufficientResources, fmt.Sprintf("%.2f CPUs requested, %d available", offer.Resources.CPUs, cpus))
+	}
+	if vm, err := mem.VirtualMemory(); err == nil && uint64(offer.Resources.MemoryMB)*1024*1024 > vm.Available {
+		return reject(protocol.RejectInsufficientResources, fmt.Sprintf("%d MB of memory requested, %d MB available", offer.Resources.MemoryMB, vm.Available/1024/1024))
+	}
+	return nil
+}
+
+// offerLimits converts an offer's resource limits for the container manager
+func offerLimits(offer protocol.JobOfferPayload) container.Limits {
+	return container.Limits{
+		CPUs:         offer.Resources.CPUs,
+		MemoryBytes:  offer.Resources.MemoryMB * 1024 * 1024,
+		PidsLimit:    offer.Resources.PidsLimit,
+		ShmSizeBytes: offer.Resources.ShmSizeMB * 1024 * 1024,
+		Timeout:      time.Duration(offer.Resources.TimeoutSeconds) * time.Second,
+	}
+}
+
+// offerSandbox converts the sandbox relaxations an offer needs for the container manager
+func offerSandbox(offer protocol.JobOfferPayload) container.Sandbox {
+	return container.Sandbox{
+		Network:        offer.Sandbox.Network,
+		WritableRootfs: offer.Sandbox.WritableRootfs,
+		RunAsRoot:      offer.Sandbox.RunAsRoot,
+	}
+}
+
+// start hands an offered job to the worker pool
+func (r *jobRunner) start(offer protocol.JobOfferPayload) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.mu.Lock()
+	r.running[offer.JobID] = cancel
+	r.mu.Unlock()
+
+	select {
+	case r.queue <- queuedJob{ctx: ctx, offer: offer}:
+	default:
+		log.Printf("Job queue full, dropping offer [%s]\n", offer.JobID)
+		r.results.deliver(r.out, protocol.JobResultPayload{
+			JobID:         offer.JobID,
+			Error:         "provider job queue full",
+			FailureReason: protocol.FailureError,
+		})
+		r.finish(offer.JobID)
+	}
+}
+
+// cancel stops a queued or running job; a running container is killed and removed by RunContainer
+func (r *jobRunner) cancel(jobID string) bool {
+	r.mu.Lock()
+	cancel, ok := r.running[jobID]
+	r.mu.Unlock()
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// finish forgets a job once it is no longer queued or running
+func (r *jobRunner) finish(jobID string) {
+	r.mu.Lock()
+	cancel, ok := r.running[jobID]
+	delete(r.running, jobID)
+	r.mu.Unlock()
+	if ok {
+		cancel()
+	}
+}
+
+// status reports slot usage and the jobs accepted but not yet reported
+func (r *jobRunner) status() protocol.HeartbeatPayload {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	hb := protocol.HeartbeatPayload{
+		Slots:     r.slots,
+		FreeSlots: r.slots - r.busy,
+		JobIDs:    make([]string, 0, len(r.running)),
+	}
+	for jobID := range r.running {
+		hb.JobIDs = append(hb.JobIDs, jobID)
+	}
+	return hb
+}
+
+// worker runs queued jobs one at a time
+func (r *jobRunner) worker() {
+	for j := range r.queue {
+		if j.ctx.Err() != nil {
+			// Cancelled while waiting for a slot
+			r.results.deliver(r.out, buildResult(j.offer.JobID, nil, j.ctx.Err()))
+			r.finish(j.offer.JobID)
+			continue
+		}
+
+		r.setBusy(1)
+		r.run(j.ctx, j.offer)
+		r.finish(j.offer.JobID)
+		r.setBusy(-1)
+	}
+}
+
+// setBusy adjusts the number of occupied slots and advertises the new capacity
+func (r *jobRunner) setBusy(delta int) {
+	r.mu.Lock()
+	r.busy += delta
+	capacity := protocol.CapacityPayload{Slots: r.slots, FreeSlots: r.slots - r.busy}
+	r.mu.Unlock()
+	r.out.send(capacity)
+}
+
+// run executes a job and reports its progress and result to the orchestrator
+func (r *jobRunner) run(ctx context.Context, offer protocol.JobOfferPayload) {
+	// Let the orchestrator know the job is running
+	r.out.send(protocol.JobStartedPayload{JobID: offer.JobID})
+
+	// Execute container
+	limits := offerLimits(offer)
+	sandbox := offerSandbox(offer)
+	// Stream output to the orchestrator as it is produced
+	var seq int64
+	onLog := func(stream, data string) {
+		seq++
+		r.out.send(protocol.JobLogPayload{
+			JobID:  offer.JobID,
+			Seq:    seq,
+			Stream: stream,
+			Data:   data,
+		})
+	}
+	run, err := container.RunContainer(ctx, offer.Image, offer.Cmd, limits, sandbox, r.policy, onLog)
+	if err != nil {
+		log.Printf("Container run failed [%s]: %v\n", offer.JobID, err)
+	}
+	result := buildResult(offer.JobID, run, err)
+
+	if result.ExitCode != nil {
+		fmt.Printf("Job Completed [%s]. Exit Code: %d | %d bytes of output\n", offer.JobID, *result.ExitCode, len(result.Stdout))
+	} else {
+		fmt.Printf("Job Failed [%s]: %s\n", offer.JobID, result.Error)
+	}
+
+	// Send Result (kept until delivered if the orchestrator is unreachable)
+	r.results.deliver(r.out, result)
+}
+
+// buildResult converts a container run into a JOB_RESULT payload, classifying any failure
+func buildResult(jobID string, run *container.Result, err error) protocol.JobResultPayload {
+	result := protocol.JobResultPayload{JobID: jobID}
+	if run != nil {
+		exitCode := run.ExitCode
+		result.ExitCode = &exitCode
+		result.Stdout = run.Stdout
+		result.Stderr = run.Stderr
+		result.StdoutTruncated = run.StdoutTruncated
+		result.StderrTruncated = run.StderrTruncated
+		result.ImageDigest = run.ImageDigest
+		result.PulledAt = run.PulledAt
+		result.StartedAt = run.StartedAt
+		result.FinishedAt = run.FinishedAt
+		result.Usage = &protocol.Usage{
+			CPUSeconds:      run.Usage.CPUSeconds,
+			MemoryGBSeconds: run.Usage.MemoryGBSeconds,
+			WallSeconds:     run.Usage.WallSeconds,
+		}
+	}
+
+	switch {
+	case err == nil && run != nil && run.ExitCode != 0:
+		result.Error = fmt.Sprintf("container exited with code %d", run.ExitCode)
+		result.FailureReason = protocol.FailureExitCode
+	case err == nil:
+	case errors.Is(err, container.ErrOOMKilled):
+		result.Error = err.Error()
+		result.FailureReason = protocol.FailureOOMKilled
+	case errors.Is(err, container.ErrTimeout):
+		result.Error = err.Error()
+		result.FailureReason = protocol.FailureTimeout
+	case errors.Is(err, container.ErrPolicyViolation):
+		result.Error = err.Error()
+		result.FailureReason = protocol.FailurePolicy
+	case errors.Is(err, context.Canceled):
+		result.Error = "job cancelled"
+		result.FailureReason = protocol.FailureCancelled
+	default:
+		result.Error = err.Error()
+		result.FailureReason = protocol.FailureError
+	}
+	return result
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Environment variable holding the keystore password when no password file is given
+const keystorePasswordEnv = "GRIDFORCE_KEYSTORE_PASSWORD"
+
+// loadSigningKey loads the wallet key used to answer the orchestrator's challenge, either from
+// a file holding a hex private key or from an encrypted geth keystore file
+func loadSigningKey(keyFile, keystoreFile, passwordFile string) (*ecdsa.PrivateKey, error) {
+	switch {
+	case keyFile != "" && keystoreFile != "":
+		return nil, errors.New("use either a key file or a keystore, not both")
+	case keyFile != "":
+		raw, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %v", err)
+		}
+		key, err := crypto.HexToECDSA(strings.TrimPrefix(strings.TrimSpace(string(raw)), "0x"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse key file: %v", err)
+		}
+		return key, nil
+	case keystoreFile != "":
+		data, err := os.ReadFile(keystoreFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read keystore: %v", err)
+		}
+		password := os.Getenv(keystorePasswordEnv)
+		if passwordFile != "" {
+			raw, err := os.ReadFile(passwordFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read keystore password: %v", err)
+			}
+			password = strings.TrimRight(string(raw), "\r\n")
+		}
+		key, err := keystore.DecryptKey(data, password)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt keystore: %v", err)
+		}
+		return key.PrivateKey, nil
+	default:
+		return nil, errors.New("no wallet key configured (use -key-file or -keystore)")
+	}
+}
@@ -1,152 +1,363 @@
 package main
 
 import (
-	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
-	"net/url"
 	"os"
 	"os/signal"
 	"runtime"
-	"strings"
+	"sync"
 	"time"
 
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/gorilla/websocket"
-	"github.com/gridforce/core/internal/platform/container"
+	"github.com/gridforce/core/internal/core/blockchain"
 	"github.com/gridforce/core/pkg/protocol"
 )
 
-// Helper for contains check
-func contains(s, substr string) bool {
-	return strings.Contains(s, substr)
+// errNotConnected is returned when sending while the provider is reconnecting
+var errNotConnected = errors.New("not connected to orchestrator")
+
+// errInterrupted ends the session when the provider is shutting down
+var errInterrupted = errors.New("interrupted")
+
+// wsSender serializes writes to the orchestrator connection; gorilla allows one writer at a time.
+// It outlives connections: jobs keep running across reconnects and send through whichever
+// connection is current.
+type wsSender struct {
+	mu   sync.Mutex
+	conn *websocket.Conn
+}
+
+// setConn switches to a new connection, or to none while reconnecting
+func (s *wsSender) setConn(conn *websocket.Conn) {
+	s.mu.Lock()
+	s.conn = conn
+	s.mu.Unlock()
+}
+
+// write sends a message on the current connection
+func (s *wsSender) write(msg protocol.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return errNotConnected
+	}
+	return s.conn.WriteJSON(msg)
+}
+
+// send marshals a payload into a protocol message and writes it
+func (s *wsSender) send(payload protocol.Payload) error {
+	msg, err := protocol.Encode(payload)
+	if err != nil {
+		return err
+	}
+	return s.write(msg)
+}
+
+// writeBinary sends a binary frame on the current connection
+func (s *wsSender) writeBinary(frame []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return errNotConnected
+	}
+	return s.conn.WriteMessage(websocket.BinaryMessage, frame)
+}
+
+// reply answers a message from the orchestrator
+func (s *wsSender) reply(to protocol.Message, payload protocol.Payload) error {
+	msg, err := protocol.EncodeReply(to, payload)
+	if err != nil {
+		return err
+	}
+	return s.write(msg)
+}
+
+// replyError answers a message from the orchestrator with an ERROR
+func (s *wsSender) replyError(to protocol.Message, code, message string) {
+	if err := s.reply(to, protocol.ErrorPayload{Code: code, Message: message}); err != nil {
+		log.Printf("write %s error: %v\n", code, err)
+	}
+}
+
+// close sends a normal closure frame
+func (s *wsSender) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return errNotConnected
+	}
+	return s.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
+
+// identity holds the keys the provider authenticates with
+type identity struct {
+	wallet     string
+	signingKey *ecdsa.PrivateKey
+	deviceKey  ed25519.PrivateKey
 }
 
 func main() {
-	flag.String("wallet", "ignored", "Flag ignored, using hardcoded wallet")
-	serverAddr := flag.String("server", "46.101.96.91:8080", "Server address (e.g. 46.101.96.91:8080 or xxx.ngrok-free.app)")
-	flag.Parse()
+	cfg, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal("config: ", err)
+	}
+	cfg.print()
 
-	// FORCE WALLET ADDRESS for Demo/testing
-	forcedWallet := "0x70997970C51812dc3A010C7d01b50e0d17dc79C8"
-	wallet := &forcedWallet
-	fmt.Printf("FORCE WALLET: %s\n", *wallet)
+	// Sandbox policy: the strictest profile unless relaxed by the config
+	policy, err := cfg.policy()
+	if err != nil {
+		log.Fatal("seccomp:", err)
+	}
+
+	// The wallet is whatever address the signing key controls
+	signingKey, err := loadSigningKey(cfg.KeyFile, cfg.Keystore, cfg.KeystorePasswordFile)
+	if err != nil {
+		log.Fatal("wallet key:", err)
+	}
+	walletAddress := crypto.PubkeyToAddress(signingKey.PublicKey).Hex()
+	if cfg.Wallet != "" && cfg.Wallet != walletAddress {
+		log.Fatalf("wallet %s does not match the signing key's address %s", cfg.Wallet, walletAddress)
+	}
+	fmt.Printf("WALLET: %s\n", walletAddress)
+
+	// The device key gives the node a stable identity across restarts and reconnects
+	deviceKey, err := loadDeviceKey(cfg.DataDir)
+	if err != nil {
+		log.Fatal("device identity:", err)
+	}
+	fmt.Printf("DEVICE: %s\n", deviceID(deviceKey))
+	id := identity{wallet: walletAddress, signingKey: signingKey, deviceKey: deviceKey}
+
+	// Results not delivered before the last shutdown are sent once connected
+	results, err := newOutbox(cfg.DataDir)
+	if err != nil {
+		log.Fatal("outbox:", err)
+	}
 
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt)
 
-	scheme := "ws"
-	// Auto-detect secure scheme for public endpoints
-	if contains(*serverAddr, "ngrok") || contains(*serverAddr, "https") {
-		scheme = "wss"
+	// Jobs survive reconnects, so the runner and sender live for the whole process
+	out := &wsSender{}
+	runner := newJobRunner(out, results, policy, cfg.Slots)
+
+	retry := &backoff{min: reconnectMinDelay, max: reconnectMaxDelay}
+	for {
+		err := runSession(cfg, id, out, runner, results, interrupt, retry.reset)
+		if errors.Is(err, errInterrupted) {
+			return
+		}
+		// Rejections (bad credentials, unsupported version) will not go away by retrying
+		var rejection protocol.ErrorPayload
+		if errors.As(err, &rejection) {
+			log.Fatal("rejected by orchestrator: ", rejection)
+		}
+
+		delay := retry.next()
+		log.Printf("Connection lost (%v), reconnecting in %s", err, delay.Round(time.Millisecond))
+		select {
+		case <-time.After(delay):
+		case <-interrupt:
+			log.Println("interrupt")
+			return
+		}
 	}
+}
 
-	u := url.URL{Scheme: scheme, Host: *serverAddr, Path: "/ws"}
-	log.Printf("Connecting to Server: %s with wallet %s", u.String(), *wallet)
+// runSession connects to the orchestrator, authenticates and serves it until the connection
+// drops or the provider is interrupted. onAuth is called once the provider has authenticated.
+func runSession(cfg *Config, id identity, out *wsSender, runner *jobRunner, results *outbox, interrupt <-chan os.Signal, onAuth func()) error {
+	log.Printf("Connecting to Server: %s with wallet %s", cfg.Server, id.wallet)
 
-	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	// Offer permessage-deflate; job outputs compress well
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = true
+	c, _, err := dialer.Dial(cfg.Server, nil)
 	if err != nil {
-		log.Fatal("dial:", err)
+		return fmt.Errorf("dial: %v", err)
 	}
 	defer c.Close()
+	c.SetReadLimit(cfg.MaxMessageSize)
+	markAlive := keepAlive(c, time.Duration(cfg.HeartbeatInterval))
 
-	// 1. Construct Auth Payload
-	authPayload := protocol.AuthPayload{
-		DeviceID:      "gpu-node-01", // Static for now, could be dynamic
-		WalletAddress: *wallet,
-		OS:            runtime.GOOS,
-		Arch:          runtime.GOARCH,
-		CpuCores:      runtime.NumCPU(),
+	// 1. Wait for the challenge and sign it with the wallet and device keys
+	var challenge protocol.Message
+	if err := c.ReadJSON(&challenge); err != nil {
+		return fmt.Errorf("read challenge: %v", err)
 	}
-
-	// 2. Marshal Payload
-	payloadBytes, err := json.Marshal(authPayload)
+	nonce, err := protocol.Decode[protocol.ChallengePayload](challenge)
 	if err != nil {
-		log.Fatal("marshal auth:", err)
+		return err
+	}
+	signature, err := blockchain.SignPersonal(id.signingKey, protocol.ChallengeMessage(nonce.Nonce))
+	if err != nil {
+		return fmt.Errorf("sign challenge: %v", err)
+	}
+	deviceSignature := ed25519.Sign(id.deviceKey, []byte(protocol.ChallengeMessage(nonce.Nonce)))
+
+	// 2. Construct Auth Payload; held jobs (running or with undelivered results) are resumed
+	heldJobs := runner.status().JobIDs
+	heldJobs = append(heldJobs, results.jobIDs()...)
+	authPayload := protocol.AuthPayload{
+		DeviceID:        deviceID(id.deviceKey),
+		WalletAddress:   id.wallet,
+		Signature:       hexutil.Encode(signature),
+		DeviceSignature: hex.EncodeToString(deviceSignature),
+		OS:              runtime.GOOS,
+		Arch:            runtime.GOARCH,
+		CpuCores:        runtime.NumCPU(),
+		Slots:           cfg.Slots,
+		Sandbox: protocol.SandboxSpec{
+			Network:        cfg.AllowNetwork,
+			WritableRootfs: cfg.AllowWritableRootfs,
+			RunAsRoot:      cfg.AllowRoot,
+		},
+		Prices:   cfg.prices(),
+		JobIDs:   heldJobs,
+		Version:  protocol.Version,
+		Features: protocol.Features,
 	}
-	log.Printf("CLIENT DEBUG: Generated JSON: %s", string(payloadBytes))
 
-	// 3. Construct Message
-	authMsg := protocol.Message{
-		Type:    protocol.TypeAuth,
-		Payload: payloadBytes,
+	// 3. Send Message
+	out.setConn(c)
+	defer out.setConn(nil)
+	if err := out.send(authPayload); err != nil {
+		return fmt.Errorf("write auth: %v", err)
 	}
+	fmt.Printf("Sent AUTH message: OS=%s Arch=%s Cores=%d Slots=%d Held Jobs=%d\n", authPayload.OS, authPayload.Arch, authPayload.CpuCores, authPayload.Slots, len(heldJobs))
 
-	// 4. Send Message
-	if err := c.WriteJSON(authMsg); err != nil {
-		log.Println("write auth:", err)
-		return
+	// 4. Wait for the orchestrator to accept (HELLO) or reject (ERROR) us
+	var reply protocol.Message
+	if err := c.ReadJSON(&reply); err != nil {
+		return fmt.Errorf("read hello: %v", err)
+	}
+	if reply.Type == protocol.TypeError {
+		rejection, err := protocol.Decode[protocol.ErrorPayload](reply)
+		if err != nil {
+			return err
+		}
+		return rejection
+	}
+	hello, err := protocol.Decode[protocol.HelloPayload](reply)
+	if err != nil {
+		return err
 	}
-	fmt.Printf("Sent AUTH message: OS=%s Arch=%s Cores=%d\n", authPayload.OS, authPayload.Arch, authPayload.CpuCores)
+	fmt.Printf("Authenticated as %s: protocol v%d, features %v\n", hello.NodeID, hello.Version, hello.Features)
+	onAuth()
+
+	// Without acknowledgements a written result counts as delivered
+	results.setAcks(protocol.HasFeature(hello.Features, protocol.FeatureAcks))
+	// Large outputs go as binary chunks that fit the orchestrator's message limit
+	results.setChunkSize(chunkSize(hello))
+	// Without the offers feature every offer is a command to run the job
+	screenOffers := protocol.HasFeature(hello.Features, protocol.FeatureOffers)
+
+	// 5. Deliver results of jobs that finished while disconnected
+	results.flush(out)
 
 	done := make(chan struct{})
+	go sendHeartbeats(out, runner, time.Duration(cfg.HeartbeatInterval), done)
 
-	// Listen for messages
+	// Listen for messages; jobs run in the background so cancels are still received
+	var readErr error
 	go func() {
 		defer close(done)
 		for {
 			_, message, err := c.ReadMessage()
 			if err != nil {
-				log.Println("read:", err)
+				readErr = fmt.Errorf("read: %v", err)
 				return
 			}
-			log.Printf("recv: %s", message)
+			markAlive()
 
 			var msg protocol.Message
 			if err := json.Unmarshal(message, &msg); err != nil {
 				log.Println("unmarshal:", err)
+				out.replyError(msg, protocol.ErrCodeBadMessage, err.Error())
 				continue
 			}
+			// Payloads carry job inputs, so only the envelope is logged
+			log.Printf("recv: %s %s", msg.Type, msg.ID)
 
 			if msg.Type == protocol.TypeJobOffer {
-				var offer struct {
-					Image string   `json:"image"`
-					Cmd   []string `json:"cmd"`
-				}
-				if err := json.Unmarshal(msg.Payload, &offer); err != nil {
+				offer, err := protocol.Decode[protocol.JobOfferPayload](msg)
+				if err != nil {
 					log.Println("unmarshal offer:", err)
+					out.replyError(msg, protocol.ErrCodeBadMessage, err.Error())
 					continue
 				}
 
-				fmt.Printf("Received Job Offer: %s %v\n", offer.Image, offer.Cmd)
-				
-				// Execute container
-				logs, err := container.RunContainer(context.Background(), offer.Image, offer.Cmd)
+				fmt.Printf("Received Job Offer [%s]: %s %v\n", offer.JobID, offer.Image, offer.Cmd)
+				if !screenOffers {
+					runner.start(offer)
+					out.reply(msg, protocol.AckPayload{})
+					continue
+				}
+				if reject := runner.screen(offer); reject != nil {
+					fmt.Printf("Rejecting Job Offer [%s]: %s (%s)\n", offer.JobID, reject.Reason, reject.Message)
+					out.reply(msg, *reject)
+					continue
+				}
+				runner.start(offer)
+				out.reply(msg, protocol.JobAcceptPayload{JobID: offer.JobID})
+			}
+
+			if msg.Type == protocol.TypeJobCancel {
+				cancel, err := protocol.Decode[protocol.JobCancelPayload](msg)
 				if err != nil {
-					log.Printf("Container run failed: %v\n", err)
-					logs = fmt.Sprintf("Error: %v", err)
+					log.Println("unmarshal cancel:", err)
+					out.replyError(msg, protocol.ErrCodeBadMessage, err.Error())
+					continue
 				}
-				
-				fmt.Printf("Job Completed. Result: %s\n", logs)
-
-				// Send Result
-				resultPayload, _ := json.Marshal(logs)
-				resultMsg := protocol.Message{
-					Type:    protocol.TypeJobResult,
-					Payload: resultPayload,
+				if runner.cancel(cancel.JobID) {
+					fmt.Printf("Cancelling Job [%s]\n", cancel.JobID)
+					out.reply(msg, protocol.AckPayload{})
+				} else {
+					out.replyError(msg, protocol.ErrCodeUnknownJob, "job "+cancel.JobID+" is not queued or running here")
 				}
-				c.WriteJSON(resultMsg)
+			}
+
+			if msg.Type == protocol.TypeAck {
+				results.acknowledge(msg.ReplyTo)
+			}
+
+			if msg.Type == protocol.TypeError {
+				rejection, err := protocol.Decode[protocol.ErrorPayload](msg)
+				if err != nil {
+					log.Println("unmarshal error:", err)
+					continue
+				}
+				log.Printf("orchestrator reported %v (reply to %s)\n", rejection, msg.ReplyTo)
+				results.rejected(msg.ReplyTo, rejection)
 			}
 		}
 	}()
 
-	for {
+	select {
+	case <-done:
+		return readErr
+	case <-interrupt:
+		log.Println("interrupt")
+		if err := out.close(); err != nil {
+			log.Println("write close:", err)
+			return errInterrupted
+		}
 		select {
 		case <-done:
-			return
-		case <-interrupt:
-			log.Println("interrupt")
-			err := c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
-			if err != nil {
-				log.Println("write close:", err)
-				return
-			}
-			select {
-			case <-done:
-			case <-time.After(time.Second):
-			}
-			return
+		case <-time.After(time.Second):
 		}
+		return errInterrupted
 	}
 }
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/gridforce/core/pkg/protocol"
+)
+
+// Directory inside the data dir holding results not yet delivered to the orchestrator
+const outboxDir = "results"
+
+const (
+	// Outputs larger than this are sent as binary chunks when the orchestrator supports them
+	inlineOutputLimit = 64 << 10
+	// Largest chunk sent, unless the orchestrator's message limit is smaller
+	maxChunkSize = 256 << 10
+)
+
+// outbox keeps job results until they are delivered, so results of jobs that finish while
+// the provider is disconnected (or restarting) are sent once it is back. When the
+// orchestrator acknowledges messages, a result counts as delivered once it is answered.
+type outbox struct {
+	dir string
+
+	mu      sync.Mutex
+	results map[string]protocol.JobResultPayload
+	acks    bool
+	sent    map[string]string // message ID -> job ID of results awaiting an answer
+	// chunkSize is the size of the binary chunks large outputs are split into; 0 inlines them
+	chunkSize int
+}
+
+// newOutbox opens the outbox in the data dir, picking up results left by a previous run
+func newOutbox(dataDir string) (*outbox, error) {
+	o := &outbox{
+		dir:     filepath.Join(dataDir, outboxDir),
+		results: make(map[string]protocol.JobResultPayload),
+		sent:    make(map[string]string),
+	}
+	if err := os.MkdirAll(o.dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create outbox: %v", err)
+	}
+
+	entries, err := os.ReadDir(o.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read outbox: %v", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(o.dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read outbox: %v", err)
+		}
+		var result protocol.JobResultPayload
+		if err := json.Unmarshal(data, &result); err != nil || result.JobID == "" {
+			log.Printf("Skipping unreadable outbox entry %s\n", entry.Name())
+			continue
+		}
+		o.results[result.JobID] = result
+	}
+	return o, nil
+}
+
+// path returns the file a job's result is kept in
+func (o *outbox) path(jobID string) string {
+	safe := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, jobID)
+	return filepath.Join(o.dir, safe+".json")
+}
+
+// add stores a result until it is delivered
+func (o *outbox) add(result protocol.JobResultPayload) {
+	o.mu.Lock()
+	o.results[result.JobID] = result
+	o.mu.Unlock()
+
+	// Keeping it on disk is best effort; the result stays queued in memory either way
+	data, err := json.Marshal(result)
+	if err == nil {
+		err = os.WriteFile(o.path(result.JobID), data, 0600)
+	}
+	if err != nil {
+		log.Printf("Failed to persist result [%s]: %v\n", result.JobID, err)
+	}
+}
+
+// remove forgets a delivered result
+func (o *outbox) remove(jobID string) {
+	o.mu.Lock()
+	delete(o.results, jobID)
+	o.mu.Unlock()
+	if err := os.Remove(o.path(jobID)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove delivered result [%s]: %v\n", jobID, err)
+	}
+}
+
+// jobIDs lists the jobs with undelivered results
+func (o *outbox) jobIDs() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	ids := make([]string, 0, len(o.results))
+	for id := range o.results {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// setAcks records whether the current orchestrator connection acknowledges messages.
+// Answers to results sent on earlier connections will not arrive any more.
+func (o *outbox) setAcks(acks bool) {
+	o.mu.Lock()
+	o.acks = acks
+	o.sent = make(map[string]string)
+	o.mu.Unlock()
+}
+
+// setChunkSize sets the chunk size negotiated with the current connection; 0 disables chunks
+func (o *outbox) setChunkSize(size int) {
+	o.mu.Lock()
+	o.chunkSize = size
+	o.mu.Unlock()
+}
+
+// chunkSize returns the size of the chunks large outputs may be sent in, or 0 if the
+// orchestrator does not accept chunks
+func chunkSize(hello protocol.HelloPayload) int {
+	if !protocol.HasFeature(hello.Features, protocol.FeatureChunks) {
+		return 0
+	}
+	size := int64(maxChunkSize)
+	if limit := hello.MaxMessageSize - protocol.ChunkOverhead; hello.MaxMessageSize > 0 && limit < size {
+		size = limit
+	}
+	if size < 1 {
+		return 0
+	}
+	return int(size)
+}
+
+// sendBlobs sends outputs too large to inline as binary chunks and replaces them in the
+// result with references to the blobs
+func sendBlobs(out *wsSender, result *protocol.JobResultPayload, chunkSize int) error {
+	streams := []struct{ data, blob *string }{
+		{&result.Stdout, &result.StdoutBlob},
+		{&result.Stderr, &result.StderrBlob},
+	}
+	for _, stream := range streams {
+		if len(*stream.data) <= inlineOutputLimit {
+			continue
+		}
+		blobID := protocol.NewID()
+		for _, chunk := range protocol.SplitBlob(blobID, []byte(*stream.data), chunkSize) {
+			frame, err := chunk.MarshalBinary()
+			if err != nil {
+				return err
+			}
+			if err := out.writeBinary(frame); err != nil {
+				return err
+			}
+		}
+		*stream.data = ""
+		*stream.blob = blobID
+	}
+	return nil
+}
+
+// send writes a result; it is forgotten right away unless an answer is expected
+func (o *outbox) send(out *wsSender, result protocol.JobResultPayload) error {
+	o.mu.Lock()
+	chunkSize := o.chunkSize
+	o.mu.Unlock()
+	// result is a copy, so the outbox keeps the inline outputs for resending
+	if chunkSize > 0 {
+		if err := sendBlobs(out, &result, chunkSize); err != nil {
+			return err
+		}
+	}
+
+	msg, err := protocol.Encode(result)
+	if err != nil {
+		return err
+	}
+	o.mu.Lock()
+	acks := o.acks
+	if acks {
+		o.sent[msg.ID] = result.JobID
+	}
+	o.mu.Unlock()
+
+	if err := out.write(msg); err != nil {
+		o.mu.Lock()
+		delete(o.sent, msg.ID)
+		o.mu.Unlock()
+		return err
+	}
+	if !acks {
+		o.remove(result.JobID)
+	}
+	return nil
+}
+
+// deliver sends a result, keeping it queued if the orchestrator cannot be reached
+func (o *outbox) deliver(out *wsSender, result protocol.JobResultPayload) {
+	o.add(result)
+	if err := o.send(out, result); err != nil {
+		log.Printf("Result [%s] queued for delivery after reconnect: %v\n", result.JobID, err)
+	}
+}
+
+// flush re-sends every queued result, stopping at the first failure
+func (o *outbox) flush(out *wsSender) {
+	o.mu.Lock()
+	pending := make([]protocol.JobResultPayload, 0, len(o.results))
+	for _, result := range o.results {
+		pending = append(pending, result)
+	}
+	o.mu.Unlock()
+
+	for _, result := range pending {
+		if err := o.send(out, result); err != nil {
+			log.Printf("Failed to re-send result [%s]: %v\n", result.JobID, err)
+			return
+		}
+		fmt.Printf("Re-sent Result [%s]\n", result.JobID)
+	}
+}
+
+// answered returns and forgets the job a result message was for
+func (o *outbox) answered(msgID string) (string, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	jobID, ok := o.sent[msgID]
+	delete(o.sent, msgID)
+	return jobID, ok
+}
+
+// acknowledge drops a result the orchestrator has recorded
+func (o *outbox) acknowledge(msgID string) {
+	if jobID, ok := o.answered(msgID); ok {
+		o.remove(jobID)
+		fmt.Printf("Result Delivered [%s]\n", jobID)
+	}
+}
+
+// rejected handles an ERROR answering a result. Results the orchestrator will never accept
+// (unknown job, reassigned, already recorded) are dropped; others are retried after the
+// next reconnect.
+func (o *outbox) rejected(msgID string, rejection protocol.ErrorPayload) {
+	jobID, ok := o.answered(msgID)
+	if !ok {
+		return
+	}
+	switch rejection.Code {
+	case protocol.ErrCodeUnknownJob, protocol.ErrCodeNotAssigned, protocol.ErrCodeDuplicateResult, protocol.ErrCodeBadMessage:
+		o.remove(jobID)
+		log.Printf("Result [%s] dropped: %v\n", jobID, rejection)
+	default:
+		log.Printf("Result [%s] kept for retry: %v\n", jobID, rejection)
+	}
+}
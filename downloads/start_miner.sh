@@ -1,6 +1,32 @@
 #!/bin/bash
+# Starts the provider. Settings already in GRIDFORCE_* environment variables are kept and
+# anything missing is asked for; with GRIDFORCE_CONFIG set, the config file is used as is.
+# Extra arguments are passed on to the provider, e.g. -slots 2.
 echo "=== GRIDFORCE MINER SETUP ==="
-echo "Lutfen Cüzdan Adresinizi (Wallet ID) girin:"
-read wallet_id
-echo "Madenci baslatiliyor... (Cikmak icin Ctrl+C)"
-./downloads/client -wallet "$wallet_id"
\ No newline at end of file
+
+if [ -n "$GRIDFORCE_CONFIG" ]; then
+    echo "Madenci baslatiliyor: $GRIDFORCE_CONFIG (Cikmak icin Ctrl+C)"
+    exec ./downloads/client "$@"
+fi
+
+# Orchestrator adresi (ws:// veya wss://)
+export GRIDFORCE_SERVER="${GRIDFORCE_SERVER:-ws://localhost:8080}"
+
+# AUTH mesajini imzalamak icin cuzdan anahtari gerekli
+if [ -z "$GRIDFORCE_KEY_FILE" ] && [ -z "$GRIDFORCE_KEYSTORE" ]; then
+    echo "Cuzdan anahtar dosyanizin yolunu girin (hex private key iceren dosya):"
+    read -r key_file
+    export GRIDFORCE_KEY_FILE="$key_file"
+fi
+
+# Cuzdan adresi istege bagli; bos birakilirsa anahtardan turetilir
+if [ -z "$GRIDFORCE_WALLET" ]; then
+    echo "Lutfen Cüzdan Adresinizi (Wallet ID) girin (bos: anahtardan turet):"
+    read -r wallet_id
+    if [ -n "$wallet_id" ]; then
+        export GRIDFORCE_WALLET="$wallet_id"
+    fi
+fi
+
+echo "Madenci baslatiliyor: $GRIDFORCE_SERVER (Cikmak icin Ctrl+C)"
+exec ./downloads/client "$@"
@@ -0,0 +1,37 @@
+package billing
+
+import (
+	"math"
+	"time"
+)
+
+// Usage is what a job consumed, as metered by the provider that ran it
+type Usage struct {
+	CPUSeconds      float64 // core-seconds of CPU time
+	MemoryGBSeconds float64 // memory in use, in GB, integrated over the run
+	WallSeconds     float64 // time the container ran
+}
+
+// Allocation is the usage of a job that kept its full allocation busy for the given time.
+// It is used to size reservations and to bill runs the provider could not meter.
+func Allocation(cores, memoryGB float64, wall time.Duration) Usage {
+	secs := wall.Seconds()
+	return Usage{
+		CPUSeconds:      cores * secs,
+		MemoryGBSeconds: memoryGB * secs,
+		WallSeconds:     secs,
+	}
+}
+
+// Tariff prices usage in credits per hour of each unit
+type Tariff struct {
+	CoreHour     float64 // per core-hour of CPU time
+	MemoryGBHour float64 // per GB-hour of memory
+	WallHour     float64 // per hour of wall time
+}
+
+// Cost prices usage, rounding up to whole credits
+func (t Tariff) Cost(u Usage) int64 {
+	credits := (u.CPUSeconds*t.CoreHour + u.MemoryGBSeconds*t.MemoryGBHour + u.WallSeconds*t.WallHour) / 3600
+	return int64(math.Ceil(credits - 1e-9))
+}
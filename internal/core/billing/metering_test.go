@@ -0,0 +1,56 @@
+package billing
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTariffCost(t *testing.T) {
+	// 3.0000000000000004: computed at run time, where 0.1+0.2 carries float error
+	tenth := 0.1
+	noisyThree := (tenth + 0.2) * 10
+
+	tariff := Tariff{CoreHour: 10, MemoryGBHour: 2, WallHour: 1}
+	tests := []struct {
+		name   string
+		tariff Tariff
+		usage  Usage
+		want   int64
+	}{
+		{"nothing used", tariff, Usage{}, 0},
+		{"one core-hour", tariff, Usage{CPUSeconds: 3600}, 10},
+		{"four cores for 15 minutes", tariff, Usage{CPUSeconds: 4 * 900}, 10},
+		{"one GB-hour", tariff, Usage{MemoryGBSeconds: 3600}, 2},
+		{"half a GB for two hours", tariff, Usage{MemoryGBSeconds: 0.5 * 7200}, 2},
+		{"one wall hour", tariff, Usage{WallSeconds: 3600}, 1},
+		{"all units", tariff, Usage{CPUSeconds: 7200, MemoryGBSeconds: 3600, WallSeconds: 3600}, 23},
+
+		// Fractions of a credit are charged as a whole credit
+		{"one core-second", tariff, Usage{CPUSeconds: 1}, 1},
+		{"just over a credit", tariff, Usage{CPUSeconds: 361}, 2},
+		{"fractions add up before rounding", tariff, Usage{CPUSeconds: 180, MemoryGBSeconds: 900, WallSeconds: 1800}, 2},
+		// Float noise just above a whole number is not rounded up
+		{"exact despite float error", Tariff{WallHour: 1}, Usage{WallSeconds: noisyThree * 3600}, 3},
+
+		{"free tariff", Tariff{}, Usage{CPUSeconds: 1e6, MemoryGBSeconds: 1e6, WallSeconds: 1e6}, 0},
+		{"only wall time priced", Tariff{WallHour: 3600}, Usage{CPUSeconds: 50, WallSeconds: 2.5}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.tariff.Cost(tt.usage); got != tt.want {
+				t.Fatalf("Cost(%+v) = %d, want %d", tt.usage, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllocation(t *testing.T) {
+	got := Allocation(2, 1.5, 90*time.Second)
+	want := Usage{CPUSeconds: 180, MemoryGBSeconds: 135, WallSeconds: 90}
+	if got != want {
+		t.Fatalf("Allocation = %+v, want %+v", got, want)
+	}
+	if got := Allocation(4, 8, 0); got != (Usage{}) {
+		t.Fatalf("Allocation over no time = %+v, want zero usage", got)
+	}
+}
@@ -0,0 +1,231 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Staff Roles; admins may do everything operators may
+const (
+	RoleAdmin    = "admin"
+	RoleOperator = "operator"
+)
+
+// Audited Actions
+const (
+	AuditCustomerCreate    = "CUSTOMER_CREATE"
+	AuditCreditGrant       = "CREDIT_GRANT"
+	AuditCustomerSuspend   = "CUSTOMER_SUSPEND"
+	AuditCustomerReinstate = "CUSTOMER_REINSTATE"
+	AuditNodeBan           = "NODE_BAN"
+	AuditNodeUnban         = "NODE_UNBAN"
+	AuditTokenCreate       = "TOKEN_CREATE"
+	AuditTokenRevoke       = "TOKEN_REVOKE"
+)
+
+// ErrInvalidAdminToken is returned for admin tokens that do not exist or were revoked
+var ErrInvalidAdminToken = errors.New("invalid admin token")
+
+// Actor is the staff member behind an admin action
+type Actor struct {
+	ID   string // admin token ID
+	Name string
+	Role string
+}
+
+// AdminToken is a credential of the admin API, held by an admin or operator. Like API keys,
+// only its hash is stored.
+type AdminToken struct {
+	ID         string `gorm:"primaryKey"`
+	Name       string
+	Role       string
+	Prefix     string // start of the token, for display
+	Hash       string `gorm:"uniqueIndex"`
+	CreatedBy  string // name of the actor that issued it
+	RevokedAt  *time.Time
+	LastUsedAt *time.Time
+	CreatedAt  time.Time
+}
+
+// AuditEntry records an admin action. Entries are only ever appended.
+type AuditEntry struct {
+	ID        uint   `gorm:"primaryKey"`
+	ActorID   string `gorm:"index"`
+	ActorName string
+	ActorRole string
+	Action    string `gorm:"index"`
+	Target    string `gorm:"index"` // ID of the customer, node or token acted on
+	Details   string
+	CreatedAt time.Time
+}
+
+// audit appends an entry for an action within tx
+func audit(tx *gorm.DB, actor Actor, action, target, details string) error {
+	return tx.Create(&AuditEntry{
+		ActorID:   actor.ID,
+		ActorName: actor.Name,
+		ActorRole: actor.Role,
+		Action:    action,
+		Target:    target,
+		Details:   details,
+	}).Error
+}
+
+// AuditEntries returns the most recent audit entries, newest first
+func AuditEntries(limit int) ([]AuditEntry, error) {
+	var entries []AuditEntry
+	err := DB.Order("id desc").Limit(limit).Find(&entries).Error
+	return entries, err
+}
+
+// CreateAdminToken stores a new admin token for secret
+func CreateAdminToken(actor Actor, name, role, secret string) (*AdminToken, error) {
+	if role != RoleAdmin && role != RoleOperator {
+		return nil, fmt.Errorf("unknown role %q", role)
+	}
+	prefix := secret
+	if len(prefix) > keyPrefixLength {
+		prefix = prefix[:keyPrefixLength]
+	}
+	token := &AdminToken{
+		ID:        uuid.New().String(),
+		Name:      name,
+		Role:      role,
+		Prefix:    prefix,
+		Hash:      HashAPIKey(secret),
+		CreatedBy: actor.Name,
+	}
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(token).Error; err != nil {
+			return err
+		}
+		return audit(tx, actor, AuditTokenCreate, token.ID, fmt.Sprintf("%s token %q", role, name))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// AuthenticateAdminToken resolves an admin token; unknown and revoked tokens fail with
+// ErrInvalidAdminToken
+func AuthenticateAdminToken(secret string) (*AdminToken, error) {
+	var token AdminToken
+	if err := DB.First(&token, "hash = ? AND revoked_at IS NULL", HashAPIKey(secret)).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidAdminToken
+		}
+		return nil, err
+	}
+	now := time.Now()
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) >= keyUsageResolution {
+		if err := DB.Model(&token).Update("last_used_at", now).Error; err != nil {
+			log.Printf("Failed to record use of admin token %s: %v\n", token.ID, err)
+		}
+	}
+	return &token, nil
+}
+
+// AdminTokens lists all admin tokens, newest first
+func AdminTokens() ([]AdminToken, error) {
+	var tokens []AdminToken
+	err := DB.Order("created_at desc").Find(&tokens).Error
+	return tokens, err
+}
+
+// RevokeAdminToken revokes an admin token. Revoking a revoked token is a no-op.
+func RevokeAdminToken(actor Actor, tokenID string) (*AdminToken, error) {
+	var token AdminToken
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&token, "id = ?", tokenID).Error; err != nil {
+			return err
+		}
+		if token.RevokedAt != nil {
+			return nil
+		}
+		now := time.Now()
+		token.RevokedAt = &now
+		if err := tx.Model(&token).Update("revoked_at", now).Error; err != nil {
+			return err
+		}
+		return audit(tx, actor, AuditTokenRevoke, token.ID, fmt.Sprintf("%s token %q", token.Role, token.Name))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// SuspendCustomer blocks a customer's API access. Jobs already submitted run to completion.
+func SuspendCustomer(actor Actor, customerID, reason string) (*Customer, error) {
+	return setSuspension(actor, customerID, reason, true)
+}
+
+// ReinstateCustomer lifts a customer's suspension
+func ReinstateCustomer(actor Actor, customerID, reason string) (*Customer, error) {
+	return setSuspension(actor, customerID, reason, false)
+}
+
+func setSuspension(actor Actor, customerID, reason string, suspend bool) (*Customer, error) {
+	var customer Customer
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&customer, "id = ?", customerID).Error; err != nil {
+			return err
+		}
+		action := AuditCustomerReinstate
+		customer.SuspendedAt, customer.SuspendReason = nil, ""
+		if suspend {
+			action = AuditCustomerSuspend
+			now := time.Now()
+			customer.SuspendedAt, customer.SuspendReason = &now, reason
+		}
+		if err := tx.Model(&customer).Select("suspended_at", "suspend_reason").Updates(&customer).Error; err != nil {
+			return err
+		}
+		return audit(tx, actor, action, customer.ID, reason)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &customer, nil
+}
+
+// BanNode refuses a node's connections until it is unbanned
+func BanNode(actor Actor, nodeID, reason string) (*Node, error) {
+	return setBan(actor, nodeID, reason, true)
+}
+
+// UnbanNode lets a banned node connect again
+func UnbanNode(actor Actor, nodeID, reason string) (*Node, error) {
+	return setBan(actor, nodeID, reason, false)
+}
+
+func setBan(actor Actor, nodeID, reason string, ban bool) (*Node, error) {
+	var node Node
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&node, "id = ?", nodeID).Error; err != nil {
+			return err
+		}
+		action := AuditNodeUnban
+		node.BannedAt, node.BanReason = nil, ""
+		if ban {
+			action = AuditNodeBan
+			now := time.Now()
+			node.BannedAt, node.BanReason = &now, reason
+		}
+		if err := tx.Model(&node).Select("banned_at", "ban_reason").Updates(&node).Error; err != nil {
+			return err
+		}
+		return audit(tx, actor, action, node.ID, reason)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &node, nil
+}
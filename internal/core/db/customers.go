@@ -0,0 +1,276 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// API Key Scopes
+const (
+	ScopeJobsRead    = "jobs:read"    // read jobs and their logs
+	ScopeJobsWrite   = "jobs:write"   // submit and cancel jobs
+	ScopeBillingRead = "billing:read" // read the balance and ledger
+	ScopeKeysManage  = "keys:manage"  // create, rotate and revoke API keys
+)
+
+// AllScopes lists every scope; keys are issued with all of them unless narrowed
+var AllScopes = []string{ScopeJobsRead, ScopeJobsWrite, ScopeBillingRead, ScopeKeysManage}
+
+// Characters of a key kept in the clear so customers can tell their keys apart
+const keyPrefixLength = 12
+
+// How often a key's last use is written back; requests in between do not touch the row
+const keyUsageResolution = time.Minute
+
+var (
+	// ErrInvalidAPIKey is returned for keys that do not exist
+	ErrInvalidAPIKey = errors.New("invalid API key")
+	// ErrAPIKeyRevoked is returned for keys that were revoked
+	ErrAPIKeyRevoked = errors.New("API key revoked")
+	// ErrAPIKeyExpired is returned for keys past their expiry
+	ErrAPIKeyExpired = errors.New("API key expired")
+	// ErrScopeExceeded is returned when a key would get scopes its issuer does not hold
+	ErrScopeExceeded = errors.New("API key scopes exceed the caller's")
+	// ErrEmailTaken is returned when another customer already has the email address
+	ErrEmailTaken = errors.New("email already in use")
+)
+
+// APIKey is one of a customer's credentials. Only the SHA-256 hash of the key is stored;
+// the key itself is shown once, when it is issued.
+type APIKey struct {
+	ID         string `gorm:"primaryKey"`
+	CustomerID string `gorm:"index"`
+	Name       string
+	Prefix     string   // start of the key, for display
+	Hash       string   `gorm:"uniqueIndex"`
+	Scopes     []string `gorm:"serializer:json"`
+	ExpiresAt  *time.Time
+	RevokedAt  *time.Time
+	LastUsedAt *time.Time
+	CreatedAt  time.Time
+}
+
+// HasScope reports whether the key grants a scope
+func (k *APIKey) HasScope(scope string) bool {
+	return slices.Contains(k.Scopes, scope)
+}
+
+// Active reports whether the key can still be used
+func (k *APIKey) Active() bool {
+	return k.RevokedAt == nil && (k.ExpiresAt == nil || time.Now().Before(*k.ExpiresAt))
+}
+
+// HashAPIKey returns the hash a key is stored and looked up by. Keys are long random
+// strings, so a fast unsalted hash is enough to make a leaked table useless.
+func HashAPIKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewAPIKey prepares a key for secret; it is stored by CreateCustomer or CreateAPIKey
+func NewAPIKey(name, secret string, scopes []string, expiresAt *time.Time) *APIKey {
+	prefix := secret
+	if len(prefix) > keyPrefixLength {
+		prefix = prefix[:keyPrefixLength]
+	}
+	return &APIKey{
+		ID:        uuid.New().String(),
+		Name:      name,
+		Prefix:    prefix,
+		Hash:      HashAPIKey(secret),
+		Scopes:    slices.Clone(scopes),
+		ExpiresAt: expiresAt,
+	}
+}
+
+// CreateAPIKey stores a new key of a customer
+func CreateAPIKey(customerID string, key *APIKey) error {
+	key.CustomerID = customerID
+	return DB.Create(key).Error
+}
+
+// AuthenticateAPIKey resolves a key to its customer. Unknown, revoked and expired keys fail
+// with ErrInvalidAPIKey, ErrAPIKeyRevoked and ErrAPIKeyExpired.
+func AuthenticateAPIKey(secret string) (*Customer, *APIKey, error) {
+	var key APIKey
+	if err := DB.First(&key, "hash = ?", HashAPIKey(secret)).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, ErrInvalidAPIKey
+		}
+		return nil, nil, err
+	}
+	if key.RevokedAt != nil {
+		return nil, nil, ErrAPIKeyRevoked
+	}
+	if key.ExpiresAt != nil && !time.Now().Before(*key.ExpiresAt) {
+		return nil, nil, ErrAPIKeyExpired
+	}
+
+	var customer Customer
+	if err := DB.First(&customer, "id = ?", key.CustomerID).Error; err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= keyUsageResolution {
+		if err := DB.Model(&key).Update("last_used_at", now).Error; err != nil {
+			log.Printf("Failed to record use of API key %s: %v\n", key.ID, err)
+		}
+	}
+	return &customer, &key, nil
+}
+
+// APIKeys lists a customer's keys, newest first
+func APIKeys(customerID string) ([]APIKey, error) {
+	var keys []APIKey
+	err := DB.Where("customer_id = ?", customerID).Order("created_at desc").Find(&keys).Error
+	return keys, err
+}
+
+// RevokeAPIKey revokes one of a customer's keys. Revoking a revoked key is a no-op.
+func RevokeAPIKey(customerID, keyID string) (*APIKey, error) {
+	var key APIKey
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			First(&key, "id = ? AND customer_id = ?", keyID, customerID).Error; err != nil {
+			return err
+		}
+		if key.RevokedAt != nil {
+			return nil
+		}
+		now := time.Now()
+		key.RevokedAt = &now
+		return tx.Model(&key).Update("revoked_at", now).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// RotateAPIKey replaces one of a customer's active keys with a new key for secret, with the
+// same name, scopes and expiry. Only keys whose scopes are all in allowed may be rotated,
+// failing with ErrScopeExceeded otherwise. The old key keeps working for grace, so clients
+// can switch over, and is revoked right away if grace is zero.
+func RotateAPIKey(customerID, keyID, secret string, allowed []string, grace time.Duration) (*APIKey, error) {
+	var rotated *APIKey
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var old APIKey
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			First(&old, "id = ? AND customer_id = ?", keyID, customerID).Error; err != nil {
+			return err
+		}
+		if old.RevokedAt != nil {
+			return ErrAPIKeyRevoked
+		}
+		if !old.Active() {
+			return ErrAPIKeyExpired
+		}
+		for _, scope := range old.Scopes {
+			if !slices.Contains(allowed, scope) {
+				return ErrScopeExceeded
+			}
+		}
+
+		rotated = NewAPIKey(old.Name, secret, old.Scopes, old.ExpiresAt)
+		rotated.CustomerID = customerID
+		if err := tx.Create(rotated).Error; err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if grace <= 0 {
+			return tx.Model(&old).Update("revoked_at", now).Error
+		}
+		until := now.Add(grace)
+		if old.ExpiresAt != nil && old.ExpiresAt.Before(until) {
+			return nil
+		}
+		return tx.Model(&old).Update("expires_at", until).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rotated, nil
+}
+
+// isEmailConflict reports whether err is a violation of the unique customer email index
+func isEmailConflict(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == "idx_customers_email"
+}
+
+// migrateCustomerEmailIndex drops the non-unique email index customers used to have, so
+// AutoMigrate replaces it with the unique one. Emails taken by several customers must be
+// resolved by hand first.
+func migrateCustomerEmailIndex() error {
+	if !DB.Migrator().HasTable(&Customer{}) {
+		return nil
+	}
+	indexes, err := DB.Migrator().GetIndexes(&Customer{})
+	if err != nil {
+		return err
+	}
+	for _, idx := range indexes {
+		if idx.Name() != "idx_customers_email" {
+			continue
+		}
+		if unique, _ := idx.Unique(); unique {
+			return nil
+		}
+		var duplicates []string
+		err := DB.Model(&Customer{}).Where("email <> ''").Group("email").Having("COUNT(*) > 1").Pluck("email", &duplicates).Error
+		if err != nil {
+			return err
+		}
+		if len(duplicates) > 0 {
+			return fmt.Errorf("emails used by several customers: %s", strings.Join(duplicates, ", "))
+		}
+		return DB.Migrator().DropIndex(&Customer{}, "idx_customers_email")
+	}
+	return nil
+}
+
+// migrateLegacyAPIKeys moves keys from the plaintext api_key column customers used to have
+// into hashed API keys, then drops the column
+func migrateLegacyAPIKeys() error {
+	if !DB.Migrator().HasColumn(&Customer{}, "api_key") {
+		return nil
+	}
+	var legacy []struct {
+		ID     string
+		ApiKey string
+	}
+	if err := DB.Table("customers").Select("id, api_key").Where("api_key <> ''").Scan(&legacy).Error; err != nil {
+		return err
+	}
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		for _, c := range legacy {
+			key := NewAPIKey("legacy", c.ApiKey, AllScopes, nil)
+			key.CustomerID = c.ID
+			if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(key).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := DB.Migrator().DropColumn(&Customer{}, "api_key"); err != nil {
+		return err
+	}
+	log.Printf("Migrated %d plaintext API key(s) to hashed keys\n", len(legacy))
+	return nil
+}
@@ -5,40 +5,155 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/gridforce/core/internal/core/billing"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
 
 var DB *gorm.DB
 
+// Node is a provider device, keyed by its device ID (the hex-encoded Ed25519 public key the
+// provider generates once and keeps), so it survives reconnects from new addresses
 type Node struct {
-	ID            string `gorm:"primaryKey"`
-	IPAddress     string
-	Status        string
-	LastSeen      time.Time
-	Tokens        int64
+	ID             string `gorm:"primaryKey"`
+	IPAddress      string
+	Status         string
+	LastSeen       time.Time
+	Tokens         int64
 	WalletAddress  string
 	Specs          string
 	BenchmarkScore int
+	// Answers to job offers
+	OffersAccepted int64
+	OffersRejected int64
+	// A banned node's connections are refused
+	BannedAt  *time.Time
+	BanReason string
+	CreatedAt time.Time
+}
+
+// NodeConnection is one authenticated connection of a node
+type NodeConnection struct {
+	ID             uint   `gorm:"primaryKey"`
+	NodeID         string `gorm:"index"`
+	IPAddress      string
+	WalletAddress  string
+	ConnectedAt    time.Time
+	DisconnectedAt *time.Time
+}
+
+// OfferRejection records a job offer a node declined or left unanswered
+type OfferRejection struct {
+	ID        uint   `gorm:"primaryKey"`
+	NodeID    string `gorm:"index"`
+	JobID     string `gorm:"index"`
+	Reason    string // e.g. BUSY or IMAGE_NOT_ALLOWED
+	Message   string
+	CreatedAt time.Time
 }
 
 type Job struct {
-	ID     uint `gorm:"primaryKey"`
-	NodeID string
-	Image  string
-	Status string
-	Result string
+	ID         string `gorm:"primaryKey"`
+	CustomerID string `gorm:"index"`
+	NodeID     string `gorm:"index"`
+	Image      string
+	Cmd        []string `gorm:"serializer:json"`
+	Status     string   `gorm:"index"`
+
+	// Benchmark jobs are queued by operators to score the provider that runs them; only the
+	// orchestrator sets this
+	Benchmark bool
+
+	// Placement requirements
+	MinCores          int
+	Platform          string
+	MinBenchmarkScore int
+
+	// Resource limits enforced by the provider
+	CPUs           float64
+	MemoryMB       int64
+	PidsLimit      int64
+	ShmSizeMB      int64
+	TimeoutSeconds int
+
+	// Sandbox relaxations the job needs
+	NeedsNetwork        bool
+	NeedsWritableRootfs bool
+	NeedsRoot           bool
+
+	// Outcome as reported by the provider
+	Result              string // stdout
+	Stderr              string
+	StdoutTruncated     bool
+	StderrTruncated     bool
+	ExitCode            *int
+	ImageDigest         string
+	PulledAt            *time.Time
+	ContainerStartedAt  *time.Time
+	ContainerFinishedAt *time.Time
+	Error               string
+	FailureReason       string // e.g. OOM_KILLED or TIMEOUT
+
+	// Usage metered by the provider
+	CPUSeconds      float64 // core-seconds
+	MemoryGBSeconds float64
+	WallSeconds     float64
+
+	// Pricing: the most the customer accepts to pay (0: no cap), and the rates of the
+	// provider the job was last assigned to
+	MaxPrice int64
+	Rates    billing.Tariff `gorm:"embedded;embeddedPrefix:rate_"`
+
+	// Billing: Reserved credits are held at submit; at settlement the hold is released and
+	// Cost, the metered usage, is charged. Cost is split into the provider's reward and the
+	// platform fee.
+	Reserved       int64
+	Cost           int64
+	ProviderReward int64
+	PlatformFee    int64
+	SettledAt      *time.Time
+
+	// LogSeqBase offsets provider log sequence numbers so they keep increasing across attempts
+	LogSeqBase int64
+	// NodeLosses counts the times the job was requeued because its node went away
+	NodeLosses int
+
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	QueuedAt   time.Time `gorm:"index"` // when the job last entered the queue
+	AssignedAt *time.Time
+	StartedAt  *time.Time
+	FinishedAt *time.Time
+}
+
+// JobLog is one chunk of a job's live output, kept so log readers can resume after reconnecting
+type JobLog struct {
+	ID        uint   `gorm:"primaryKey"`
+	JobID     string `gorm:"uniqueIndex:idx_job_log_seq"`
+	Seq       int64  `gorm:"uniqueIndex:idx_job_log_seq"`
+	Stream    string
+	Data      string
+	CreatedAt time.Time
 }
 
+// Customer is an account that submits and pays for jobs. It authenticates with any of its
+// API keys.
 type Customer struct {
-	ID      string `gorm:"primaryKey"`
-	ApiKey  string `gorm:"uniqueIndex"`
+	ID    string `gorm:"primaryKey"`
+	Name  string
+	Email string `gorm:"uniqueIndex:idx_customers_email,where:email <> ''"` // lowercased; optional
+	// Credits is the available balance; holds on unsettled jobs are already deducted.
+	// It only changes together with an appended LedgerEntry.
 	Credits int64
+	// A suspended customer's API keys are refused
+	SuspendedAt   *time.Time
+	SuspendReason string
+	CreatedAt     time.Time
 }
 
 func InitDB(dsn string) {
 	var err error
-	
+
 	// Retry loop for DB connection
 	for i := 0; i < 15; i++ {
 		DB, err = gorm.Open(postgres.Open(dsn), &gorm.Config{})
@@ -56,21 +171,34 @@ func InitDB(dsn string) {
 	log.Println("Database connection established")
 
 	// Auto Migrate
-	err = DB.AutoMigrate(&Node{}, &Job{}, &Customer{})
+	if err := migrateLegacyJobIDs(); err != nil {
+		log.Fatal("Failed to migrate job IDs:", err)
+	}
+	if err := migrateCustomerEmailIndex(); err != nil {
+		log.Fatal("Failed to migrate customer emails:", err)
+	}
+	err = DB.AutoMigrate(&Node{}, &NodeConnection{}, &OfferRejection{}, &Job{}, &JobLog{}, &Customer{}, &APIKey{}, &LedgerEntry{}, &AdminToken{}, &AuditEntry{})
 	if err != nil {
 		log.Fatal("Failed to migrate database:", err)
 	}
+	if err := migrateLegacyAPIKeys(); err != nil {
+		log.Fatal("Failed to migrate API keys:", err)
+	}
+	if err := migrateOpeningBalances(); err != nil {
+		log.Fatal("Failed to migrate opening balances:", err)
+	}
 
 	// Seed Demo Customer
 	var count int64
 	DB.Model(&Customer{}).Count(&count)
 	if count == 0 {
 		demoCustomer := Customer{
-			ID:      uuid.New().String(),
-			ApiKey:  "sk_live_demo12345",
-			Credits: 1000,
+			ID:   uuid.New().String(),
+			Name: "Demo",
 		}
-		if err := DB.Create(&demoCustomer).Error; err != nil {
+		demoKey := NewAPIKey("default", "sk_live_demo12345", AllScopes, nil)
+		seeder := Actor{ID: "seed", Name: "seed", Role: RoleAdmin}
+		if err := CreateCustomer(seeder, &demoCustomer, 1000, demoKey); err != nil {
 			log.Printf("Failed to seed demo customer: %v", err)
 		} else {
 			log.Println("Seeded Demo Customer (API Key: sk_live_demo12345)")
@@ -0,0 +1,369 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gridforce/core/internal/core/billing"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Job States
+const (
+	JobQueued    = "QUEUED"
+	JobAssigned  = "ASSIGNED"
+	JobRunning   = "RUNNING"
+	JobSucceeded = "SUCCEEDED"
+	JobFailed    = "FAILED"
+	JobCancelled = "CANCELLED"
+	JobTimedOut  = "TIMED_OUT"
+)
+
+// ErrInvalidTransition is returned when a job is not in a state that allows the requested transition
+var ErrInvalidTransition = errors.New("invalid job state transition")
+
+// ErrNoJobAssigned is returned by AssignNextJob when no queued job could be placed
+var ErrNoJobAssigned = errors.New("no queued job assigned")
+
+// assignBatchSize bounds how many queued jobs are locked per AssignNextJob call
+const assignBatchSize = 50
+
+// jobTransitions lists, for every target state, the states a job may move from
+var jobTransitions = map[string][]string{
+	JobQueued:    {JobAssigned, JobRunning},
+	JobAssigned:  {JobQueued},
+	JobRunning:   {JobAssigned},
+	JobSucceeded: {JobAssigned, JobRunning},
+	JobFailed:    {JobQueued, JobAssigned, JobRunning},
+	JobCancelled: {JobQueued, JobAssigned, JobRunning},
+	JobTimedOut:  {JobAssigned, JobRunning},
+}
+
+// IsTerminal reports whether a job in the given state will never change again
+func IsTerminal(status string) bool {
+	switch status {
+	case JobSucceeded, JobFailed, JobCancelled, JobTimedOut:
+		return true
+	}
+	return false
+}
+
+// CanTransition reports whether a job may move from one state to another
+func CanTransition(from, to string) bool {
+	for _, s := range jobTransitions[to] {
+		if s == from {
+			return true
+		}
+	}
+	return false
+}
+
+// TransitionJob atomically moves a job into a new state, applying any extra column updates
+// in the same statement. Lifecycle timestamps are filled in automatically.
+func TransitionJob(id, to string, updates map[string]interface{}) error {
+	return transitionJob(DB.Where("id = ?", id), to, updates)
+}
+
+// TransitionNodeJob is TransitionJob for messages from a provider: the job only moves if it
+// is assigned to that provider's node
+func TransitionNodeJob(id, nodeID, to string, updates map[string]interface{}) error {
+	return transitionJob(DB.Where("id = ? AND node_id = ?", id, nodeID), to, updates)
+}
+
+// transitionJob moves the job matched by scope into a new state
+func transitionJob(scope *gorm.DB, to string, updates map[string]interface{}) error {
+	from, ok := jobTransitions[to]
+	if !ok {
+		return ErrInvalidTransition
+	}
+
+	if updates == nil {
+		updates = map[string]interface{}{}
+	}
+	updates["status"] = to
+
+	now := time.Now()
+	switch {
+	case to == JobQueued:
+		for k, v := range requeueUpdates(false) {
+			updates[k] = v
+		}
+	case to == JobAssigned:
+		updates["assigned_at"] = now
+	case to == JobRunning:
+		updates["started_at"] = now
+	case IsTerminal(to):
+		updates["finished_at"] = now
+	}
+
+	result := scope.Model(&Job{}).Where("status IN ?", from).Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInvalidTransition
+	}
+	return nil
+}
+
+// requeueUpdates resets a job's assignment so the dispatcher can place it again. Later
+// attempts continue the log sequence where the previous attempt stopped. nodeLost counts
+// the requeue towards the job's node losses.
+func requeueUpdates(nodeLost bool) map[string]interface{} {
+	updates := map[string]interface{}{
+		"status":       JobQueued,
+		"node_id":      "",
+		"queued_at":    time.Now(),
+		"assigned_at":  nil,
+		"started_at":   nil,
+		"log_seq_base": gorm.Expr("(SELECT COALESCE(MAX(seq), 0) FROM job_logs WHERE job_logs.job_id = jobs.id)"),
+	}
+	if nodeLost {
+		updates["node_losses"] = gorm.Expr("node_losses + 1")
+	}
+	return updates
+}
+
+// RequeueNodeJobs puts every job in flight on a node that went away back in the queue
+func RequeueNodeJobs(nodeID string) (int64, error) {
+	result := DB.Model(&Job{}).
+		Where("node_id = ? AND status IN ?", nodeID, []string{JobAssigned, JobRunning}).
+		Updates(requeueUpdates(true))
+	return result.RowsAffected, result.Error
+}
+
+// RequeueJobs puts the given jobs back in the queue if they are still in flight on the node.
+// nodeLost is set when the node lost the jobs rather than declining them.
+func RequeueJobs(nodeID string, jobIDs []string, nodeLost bool) (int64, error) {
+	if len(jobIDs) == 0 {
+		return 0, nil
+	}
+	result := DB.Model(&Job{}).
+		Where("id IN ? AND node_id = ? AND status IN ?", jobIDs, nodeID, []string{JobAssigned, JobRunning}).
+		Updates(requeueUpdates(nodeLost))
+	return result.RowsAffected, result.Error
+}
+
+// ResumeNodeJobs reconciles a reconnecting node's in-flight jobs with the jobs it reports
+// still holding: those are returned so the session can resume them, the rest are requeued
+func ResumeNodeJobs(nodeID string, held []string) ([]Job, int64, error) {
+	var jobs []Job
+	if err := DB.Where("node_id = ? AND status IN ?", nodeID, []string{JobAssigned, JobRunning}).Find(&jobs).Error; err != nil {
+		return nil, 0, err
+	}
+
+	holding := make(map[string]bool, len(held))
+	for _, id := range held {
+		holding[id] = true
+	}
+	var resumed []Job
+	var lost []string
+	for _, job := range jobs {
+		if holding[job.ID] {
+			resumed = append(resumed, job)
+		} else {
+			lost = append(lost, job.ID)
+		}
+	}
+
+	requeued, err := RequeueJobs(nodeID, lost, true)
+	return resumed, requeued, err
+}
+
+// AssignNextJob locks queued jobs oldest first and asks pick for a node to run each one on
+// and the rates it is paid at. The first job pick returns a non-empty node ID for is moved
+// to ASSIGNED and returned; jobs pick passes over stay queued. Rows are locked with SKIP
+// LOCKED, so concurrent dispatchers never hand out the same job.
+func AssignNextJob(pick func(job *Job) (string, billing.Tariff)) (*Job, error) {
+	var assigned *Job
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var queued []Job
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ?", JobQueued).
+			Order("created_at").
+			Limit(assignBatchSize).
+			Find(&queued).Error; err != nil {
+			return err
+		}
+
+		for i := range queued {
+			job := &queued[i]
+			nodeID, rates := pick(job)
+			if nodeID == "" {
+				continue
+			}
+
+			now := time.Now()
+			if err := tx.Model(job).Updates(map[string]interface{}{
+				"status":              JobAssigned,
+				"node_id":             nodeID,
+				"assigned_at":         now,
+				"rate_core_hour":      rates.CoreHour,
+				"rate_memory_gb_hour": rates.MemoryGBHour,
+				"rate_wall_hour":      rates.WallHour,
+			}).Error; err != nil {
+				return err
+			}
+			job.Status = JobAssigned
+			job.NodeID = nodeID
+			job.AssignedAt = &now
+			job.Rates = rates
+			assigned = job
+			return nil
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if assigned == nil {
+		return nil, ErrNoJobAssigned
+	}
+	return assigned, nil
+}
+
+// RecoverJobs is run at startup to requeue jobs left in flight by a previous orchestrator
+// process; their provider connections did not survive the restart.
+func RecoverJobs() (int64, error) {
+	result := DB.Model(&Job{}).
+		Where("status IN ?", []string{JobAssigned, JobRunning}).
+		Updates(requeueUpdates(true))
+	return result.RowsAffected, result.Error
+}
+
+// FailStaleJobs fails queued jobs the platform could not run: those waiting longer than
+// maxWait since they were last queued get noProvider as failure reason, those whose nodes
+// went away maxLosses times get nodeLost. The failed jobs are returned for settlement.
+func FailStaleJobs(maxWait time.Duration, maxLosses int, noProvider, nodeLost string) ([]Job, error) {
+	var failed []Job
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var stale []Job
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND (queued_at < ? OR node_losses >= ?)", JobQueued, time.Now().Add(-maxWait), maxLosses).
+			Find(&stale).Error; err != nil {
+			return err
+		}
+
+		now := time.Now()
+		for _, job := range stale {
+			reason, message := noProvider, fmt.Sprintf("no provider took the job within %s", maxWait)
+			if job.NodeLosses >= maxLosses {
+				reason, message = nodeLost, fmt.Sprintf("providers went away while running the job %d times", job.NodeLosses)
+			}
+			if err := tx.Model(&Job{}).Where("id = ?", job.ID).Updates(map[string]interface{}{
+				"status":         JobFailed,
+				"error":          message,
+				"failure_reason": reason,
+				"finished_at":    now,
+			}).Error; err != nil {
+				return err
+			}
+			job.Status = JobFailed
+			job.Error = message
+			job.FailureReason = reason
+			job.FinishedAt = &now
+			failed = append(failed, job)
+		}
+		return nil
+	})
+	return failed, err
+}
+
+// UnsettledJobs returns finished jobs whose hold was never settled, e.g. because the
+// orchestrator stopped between recording a result and settling it
+func UnsettledJobs() ([]Job, error) {
+	var jobs []Job
+	err := DB.Where("status IN ? AND settled_at IS NULL AND reserved > 0", []string{JobSucceeded, JobFailed, JobCancelled, JobTimedOut}).Find(&jobs).Error
+	return jobs, err
+}
+
+// AppendJobLog stores a log chunk, ignoring chunks that were already received
+func AppendJobLog(chunk *JobLog) (bool, error) {
+	result := DB.Clauses(clause.OnConflict{DoNothing: true}).Create(chunk)
+	return result.RowsAffected > 0, result.Error
+}
+
+// CancelJob cancels a job on behalf of its owner and settles it: charge returns what the
+// job has cost so far. It returns the job as it was before cancelling, with the charge it
+// was settled with.
+func CancelJob(id, customerID string, charge func(job *Job) int64) (*Job, error) {
+	var job Job
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			First(&job, "id = ? AND customer_id = ?", id, customerID).Error; err != nil {
+			return err
+		}
+		if !CanTransition(job.Status, JobCancelled) {
+			return ErrInvalidTransition
+		}
+
+		updates := map[string]interface{}{
+			"status":      JobCancelled,
+			"finished_at": time.Now(),
+		}
+		if err := tx.Model(&Job{}).Where("id = ?", job.ID).Updates(updates).Error; err != nil {
+			return err
+		}
+		if job.SettledAt != nil {
+			return nil
+		}
+		return settle(tx, &job, charge(&job), "cancelled by customer")
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// migrateLegacyJobIDs converts the integer primary key jobs used to have into the string
+// IDs jobs are created with now, which AutoMigrate cannot do on its own: the old IDs are
+// copied into a new text column that then replaces the old one. Legacy jobs were only
+// stored once they had completed, so they are marked SUCCEEDED. It runs before AutoMigrate.
+func migrateLegacyJobIDs() error {
+	if !DB.Migrator().HasTable(&Job{}) {
+		return nil
+	}
+	columns, err := DB.Migrator().ColumnTypes(&Job{})
+	if err != nil {
+		return err
+	}
+	legacy := false
+	for _, c := range columns {
+		if c.Name() == "id" {
+			switch strings.ToLower(c.DatabaseTypeName()) {
+			case "int2", "int4", "int8", "smallint", "integer", "bigint":
+				legacy = true
+			}
+		}
+	}
+	if !legacy {
+		return nil
+	}
+
+	var migrated int64
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		for _, stmt := range []string{
+			"ALTER TABLE jobs ADD COLUMN id_text text",
+			"UPDATE jobs SET id_text = id::text",
+			"ALTER TABLE jobs DROP COLUMN id",
+			"ALTER TABLE jobs RENAME COLUMN id_text TO id",
+			"ALTER TABLE jobs ADD PRIMARY KEY (id)",
+		} {
+			if err := tx.Exec(stmt).Error; err != nil {
+				return err
+			}
+		}
+		result := tx.Exec("UPDATE jobs SET status = ? WHERE status = ?", JobSucceeded, "COMPLETED")
+		migrated = result.RowsAffected
+		return result.Error
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Migrated job IDs to strings (%d completed job(s) marked %s)\n", migrated, JobSucceeded)
+	return nil
+}
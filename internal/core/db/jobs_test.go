@@ -0,0 +1,68 @@
+package db
+
+import "testing"
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from, to string
+		want     bool
+	}{
+		{JobQueued, JobAssigned, true},
+		{JobAssigned, JobRunning, true},
+		{JobAssigned, JobQueued, true},
+		{JobRunning, JobQueued, true},
+		{JobRunning, JobSucceeded, true},
+		{JobRunning, JobFailed, true},
+		{JobRunning, JobTimedOut, true},
+		{JobAssigned, JobSucceeded, true},
+		{JobQueued, JobFailed, true},
+		{JobQueued, JobCancelled, true},
+		{JobAssigned, JobCancelled, true},
+		{JobRunning, JobCancelled, true},
+
+		// Jobs are only started, finished or timed out once they are on a node
+		{JobQueued, JobRunning, false},
+		{JobQueued, JobSucceeded, false},
+		{JobQueued, JobTimedOut, false},
+		{JobRunning, JobAssigned, false},
+
+		// Terminal states never change again
+		{JobSucceeded, JobQueued, false},
+		{JobFailed, JobQueued, false},
+		{JobCancelled, JobQueued, false},
+		{JobTimedOut, JobQueued, false},
+		{JobSucceeded, JobFailed, false},
+		{JobFailed, JobSucceeded, false},
+		{JobCancelled, JobRunning, false},
+		{JobTimedOut, JobCancelled, false},
+
+		{JobQueued, JobQueued, false},
+		{JobRunning, "UNKNOWN", false},
+		{"", JobAssigned, false},
+	}
+	for _, tt := range tests {
+		if got := CanTransition(tt.from, tt.to); got != tt.want {
+			t.Errorf("CanTransition(%s, %s) = %t, want %t", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestTerminalStatesHaveNoExits(t *testing.T) {
+	for to, froms := range jobTransitions {
+		for _, from := range froms {
+			if IsTerminal(from) {
+				t.Errorf("terminal state %s may move to %s", from, to)
+			}
+		}
+	}
+	for _, s := range []string{JobSucceeded, JobFailed, JobCancelled, JobTimedOut} {
+		if !IsTerminal(s) {
+			t.Errorf("IsTerminal(%s) = false", s)
+		}
+	}
+	for _, s := range []string{JobQueued, JobAssigned, JobRunning} {
+		if IsTerminal(s) {
+			t.Errorf("IsTerminal(%s) = true", s)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Ledger Entry Kinds
+const (
+	LedgerGrant   = "GRANT"   // credits added to an account
+	LedgerReserve = "RESERVE" // hold on a job's estimated cost, placed at submit
+	LedgerRelease = "RELEASE" // hold returned when the job is settled
+	LedgerCharge  = "CHARGE"  // metered usage billed when the job is settled
+)
+
+// ErrInsufficientCredits is returned when a balance change would take a balance below zero
+var ErrInsufficientCredits = errors.New("insufficient credits")
+
+// LedgerEntry is one change of a customer's balance. Entries are only ever appended; a
+// customer's balance is the sum of their entries.
+type LedgerEntry struct {
+	ID           uint   `gorm:"primaryKey"`
+	CustomerID   string `gorm:"index"`
+	JobID        string `gorm:"index"`
+	Kind         string
+	Amount       int64 // positive credits the balance, negative debits it
+	BalanceAfter int64
+	Note         string
+	CreatedAt    time.Time
+}
+
+// post changes a customer's balance and appends the change to the ledger. It must run in a
+// transaction; the customer row stays locked until it ends. Changes that would take the
+// balance below zero fail with ErrInsufficientCredits.
+func post(tx *gorm.DB, customerID, jobID, kind string, amount int64, note string) (*LedgerEntry, error) {
+	var customer Customer
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&customer, "id = ?", customerID).Error; err != nil {
+		return nil, err
+	}
+	balance := customer.Credits + amount
+	if balance < 0 {
+		return nil, ErrInsufficientCredits
+	}
+	if err := tx.Model(&Customer{}).Where("id = ?", customerID).Update("credits", balance).Error; err != nil {
+		return nil, err
+	}
+
+	entry := &LedgerEntry{
+		CustomerID:   customerID,
+		JobID:        jobID,
+		Kind:         kind,
+		Amount:       amount,
+		BalanceAfter: balance,
+		Note:         note,
+	}
+	if err := tx.Create(entry).Error; err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// CreateCustomer stores a new customer with their first API keys and grants their opening
+// balance; the creation is audit-logged. It fails with ErrEmailTaken if another customer
+// has the email.
+func CreateCustomer(actor Actor, customer *Customer, credits int64, keys ...*APIKey) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		customer.Credits = 0
+		if err := tx.Create(customer).Error; err != nil {
+			if isEmailConflict(err) {
+				return ErrEmailTaken
+			}
+			return err
+		}
+		for _, key := range keys {
+			key.CustomerID = customer.ID
+			if err := tx.Create(key).Error; err != nil {
+				return err
+			}
+		}
+		if credits > 0 {
+			if _, err := post(tx, customer.ID, "", LedgerGrant, credits, "opening balance"); err != nil {
+				return err
+			}
+		}
+		customer.Credits = credits
+		return audit(tx, actor, AuditCustomerCreate, customer.ID, fmt.Sprintf("%q with %d credits", customer.Name, credits))
+	})
+}
+
+// GrantCredits adds credits to a customer's balance on behalf of an admin; the grant is
+// audit-logged
+func GrantCredits(actor Actor, customerID string, credits int64, note string) (*LedgerEntry, error) {
+	if credits <= 0 {
+		return nil, fmt.Errorf("grant must be positive, got %d", credits)
+	}
+	var entry *LedgerEntry
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if entry, err = post(tx, customerID, "", LedgerGrant, credits, note); err != nil {
+			return err
+		}
+		return audit(tx, actor, AuditCreditGrant, customerID, fmt.Sprintf("%d credits: %s", credits, note))
+	})
+	return entry, err
+}
+
+// SubmitJob stores a new job and holds reserve credits of its customer's balance for it,
+// so a job is only queued if its customer can pay for it
+func SubmitJob(job *Job, reserve int64) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		job.Reserved = reserve
+		job.Cost = 0
+		job.QueuedAt = time.Now()
+		if err := tx.Create(job).Error; err != nil {
+			return err
+		}
+		if reserve > 0 {
+			if _, err := post(tx, job.CustomerID, job.ID, LedgerReserve, -reserve, "hold for job"); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SettleJob releases a finished job's hold and charges cost for it, returning the amount
+// charged; reason says why the job ended and is recorded with the release. Settling is
+// idempotent: a job already settled keeps its charge.
+func SettleJob(jobID string, cost int64, reason string) (int64, error) {
+	var charged int64
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var job Job
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&job, "id = ?", jobID).Error; err != nil {
+			return err
+		}
+		if job.SettledAt != nil {
+			charged = job.Cost
+			return nil
+		}
+		if err := settle(tx, &job, cost, reason); err != nil {
+			return err
+		}
+		charged = job.Cost
+		return nil
+	})
+	return charged, err
+}
+
+// settle releases a job's hold and charges cost within tx. The charge is capped at what the
+// balance can cover, so a job that outran its hold never takes the balance below zero.
+func settle(tx *gorm.DB, job *Job, cost int64, reason string) error {
+	if job.Reserved > 0 {
+		if _, err := post(tx, job.CustomerID, job.ID, LedgerRelease, job.Reserved, "hold released: "+reason); err != nil {
+			return err
+		}
+	}
+
+	charge := max(cost, 0)
+	if charge > 0 {
+		var customer Customer
+		if err := tx.First(&customer, "id = ?", job.CustomerID).Error; err != nil {
+			return err
+		}
+		note := "metered usage"
+		if charge > customer.Credits {
+			note = fmt.Sprintf("metered usage of %d credits, capped at balance", charge)
+			charge = customer.Credits
+		}
+		if charge > 0 {
+			if _, err := post(tx, job.CustomerID, job.ID, LedgerCharge, -charge, note); err != nil {
+				return err
+			}
+		}
+	}
+
+	now := time.Now()
+	if err := tx.Model(&Job{}).Where("id = ?", job.ID).Updates(map[string]interface{}{
+		"cost":       charge,
+		"settled_at": now,
+	}).Error; err != nil {
+		return err
+	}
+	job.Cost = charge
+	job.SettledAt = &now
+	return nil
+}
+
+// migrateOpeningBalances writes an opening GRANT for customers whose balance predates the
+// ledger, so every balance is the sum of its customer's entries
+func migrateOpeningBalances() error {
+	var customers []Customer
+	err := DB.Where("credits <> 0").
+		Where("NOT EXISTS (SELECT 1 FROM ledger_entries WHERE ledger_entries.customer_id = customers.id)").
+		Find(&customers).Error
+	if err != nil || len(customers) == 0 {
+		return err
+	}
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		for _, c := range customers {
+			entry := &LedgerEntry{
+				CustomerID:   c.ID,
+				Kind:         LedgerGrant,
+				Amount:       c.Credits,
+				BalanceAfter: c.Credits,
+				Note:         "opening balance",
+			}
+			if err := tx.Create(entry).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Recorded opening balances of %d customer(s) in the ledger\n", len(customers))
+	return nil
+}
+
+// LedgerEntries returns a customer's most recent ledger entries, newest first
+func LedgerEntries(customerID string, limit int) ([]LedgerEntry, error) {
+	var entries []LedgerEntry
+	err := DB.Where("customer_id = ?", customerID).Order("id desc").Limit(limit).Find(&entries).Error
+	return entries, err
+}
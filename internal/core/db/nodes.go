@@ -0,0 +1,91 @@
+package db
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// OpenConnection records the start of an authenticated connection from a node
+func OpenConnection(nodeID, ipAddress, walletAddress string) (*NodeConnection, error) {
+	conn := &NodeConnection{
+		NodeID:        nodeID,
+		IPAddress:     ipAddress,
+		WalletAddress: walletAddress,
+		ConnectedAt:   time.Now(),
+	}
+	if err := DB.Create(conn).Error; err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// CloseConnection records the end of a node connection
+func CloseConnection(id uint) error {
+	return DB.Model(&NodeConnection{}).Where("id = ?", id).Update("disconnected_at", time.Now()).Error
+}
+
+// RecordOfferAccepted counts a job offer the node accepted
+func RecordOfferAccepted(nodeID string) error {
+	return DB.Model(&Node{}).Where("id = ?", nodeID).
+		Update("offers_accepted", gorm.Expr("offers_accepted + 1")).Error
+}
+
+// RecordOfferRejected stores why the node declined a job offer and counts the rejection
+func RecordOfferRejected(nodeID, jobID, reason, message string) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		rejection := OfferRejection{NodeID: nodeID, JobID: jobID, Reason: reason, Message: message}
+		if err := tx.Create(&rejection).Error; err != nil {
+			return err
+		}
+		return tx.Model(&Node{}).Where("id = ?", nodeID).
+			Update("offers_rejected", gorm.Expr("offers_rejected + 1")).Error
+	})
+}
+
+// OfferRejectionStats counts the offers a node declined, by reason
+func OfferRejectionStats(nodeID string) (map[string]int64, error) {
+	var rows []struct {
+		Reason string
+		Count  int64
+	}
+	if err := DB.Model(&OfferRejection{}).
+		Select("reason, COUNT(*) AS count").
+		Where("node_id = ?", nodeID).
+		Group("reason").
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	stats := make(map[string]int64, len(rows))
+	for _, row := range rows {
+		stats[row.Reason] = row.Count
+	}
+	return stats, nil
+}
+
+// RecordReward stores how a settled job's charge was split and credits the reward to the
+// node's tokens. It returns the updated node, or nil if the job's split was already recorded.
+func RecordReward(jobID, nodeID string, reward, fee int64) (*Node, error) {
+	var node *Node
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Job{}).
+			Where("id = ? AND settled_at IS NOT NULL AND provider_reward = 0 AND platform_fee = 0", jobID).
+			Updates(map[string]interface{}{"provider_reward": reward, "platform_fee": fee})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return nil
+		}
+		if err := tx.Model(&Node{}).Where("id = ?", nodeID).
+			Update("tokens", gorm.Expr("tokens + ?", reward)).Error; err != nil {
+			return err
+		}
+		node = &Node{}
+		return tx.First(node, "id = ?", nodeID).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return node, nil
+}
@@ -0,0 +1,51 @@
+package pricing
+
+import (
+	"math"
+
+	"github.com/gridforce/core/internal/core/billing"
+)
+
+// Quote splits what a job costs its customer into the provider's reward and the platform fee
+type Quote struct {
+	Reward int64 // paid to the provider, at its rates
+	Fee    int64 // kept by the platform
+	Total  int64 // charged to the customer
+}
+
+// Engine prices jobs: customers pay the rates of the provider that runs the job for its
+// metered usage, plus the platform fee as a percentage of the provider's reward
+type Engine struct {
+	Default    billing.Tariff // rates of providers that advertise none
+	FeePercent float64
+}
+
+// Rates returns the rates a provider is paid at
+func (e Engine) Rates(advertised billing.Tariff) billing.Tariff {
+	if advertised == (billing.Tariff{}) {
+		return e.Default
+	}
+	return advertised
+}
+
+// Quote prices usage at a provider's rates
+func (e Engine) Quote(rates billing.Tariff, u billing.Usage) Quote {
+	reward := e.Rates(rates).Cost(u)
+	fee := int64(math.Ceil(float64(reward)*e.FeePercent/100 - 1e-9))
+	return Quote{Reward: reward, Fee: fee, Total: reward + fee}
+}
+
+// Split divides a total charge into reward and fee at the engine's fee rate
+func (e Engine) Split(total int64) Quote {
+	fee := int64(math.Ceil(float64(total)*e.FeePercent/(100+e.FeePercent) - 1e-9))
+	fee = min(max(fee, 0), total)
+	return Quote{Reward: total - fee, Fee: fee, Total: total}
+}
+
+// Cap limits a quote to at most total credits, cutting reward and fee in proportion
+func (e Engine) Cap(q Quote, total int64) Quote {
+	if q.Total <= total {
+		return q
+	}
+	return e.Split(max(total, 0))
+}
@@ -0,0 +1,163 @@
+package pricing
+
+import (
+	"testing"
+
+	"github.com/gridforce/core/internal/core/billing"
+)
+
+var defaultRates = billing.Tariff{CoreHour: 10, MemoryGBHour: 2, WallHour: 1}
+
+func TestEngineQuote(t *testing.T) {
+	tests := []struct {
+		name   string
+		engine Engine
+		rates  billing.Tariff
+		usage  billing.Usage
+		want   Quote
+	}{
+		{
+			name:   "default rates for providers advertising none",
+			engine: Engine{Default: defaultRates, FeePercent: 10},
+			usage:  billing.Usage{CPUSeconds: 3600},
+			want:   Quote{Reward: 10, Fee: 1, Total: 11},
+		},
+		{
+			name:   "advertised rates",
+			engine: Engine{Default: defaultRates, FeePercent: 10},
+			rates:  billing.Tariff{CoreHour: 20},
+			usage:  billing.Usage{CPUSeconds: 3600, WallSeconds: 3600},
+			want:   Quote{Reward: 20, Fee: 2, Total: 22},
+		},
+		{
+			name:   "fee rounds up",
+			engine: Engine{Default: defaultRates, FeePercent: 10},
+			usage:  billing.Usage{CPUSeconds: 5400},
+			want:   Quote{Reward: 15, Fee: 2, Total: 17},
+		},
+		{
+			name:   "any reward carries a fee",
+			engine: Engine{Default: defaultRates, FeePercent: 10},
+			usage:  billing.Usage{CPUSeconds: 1},
+			want:   Quote{Reward: 1, Fee: 1, Total: 2},
+		},
+		{
+			name:   "exact fee is not rounded up",
+			engine: Engine{Default: defaultRates, FeePercent: 2.5},
+			usage:  billing.Usage{CPUSeconds: 40 * 3600},
+			want:   Quote{Reward: 400, Fee: 10, Total: 410},
+		},
+		{
+			name:   "zero rates",
+			engine: Engine{FeePercent: 10},
+			usage:  billing.Usage{CPUSeconds: 3600, MemoryGBSeconds: 3600, WallSeconds: 3600},
+			want:   Quote{},
+		},
+		{
+			name:   "zero rate for a unit",
+			engine: Engine{Default: defaultRates, FeePercent: 10},
+			rates:  billing.Tariff{WallHour: 5},
+			usage:  billing.Usage{CPUSeconds: 3600, WallSeconds: 3600},
+			want:   Quote{Reward: 5, Fee: 1, Total: 6},
+		},
+		{
+			name:   "no fee",
+			engine: Engine{Default: defaultRates},
+			usage:  billing.Usage{CPUSeconds: 5400},
+			want:   Quote{Reward: 15, Fee: 0, Total: 15},
+		},
+		{
+			name:   "fee of 100%",
+			engine: Engine{Default: defaultRates, FeePercent: 100},
+			usage:  billing.Usage{CPUSeconds: 5400},
+			want:   Quote{Reward: 15, Fee: 15, Total: 30},
+		},
+		{
+			name:   "no usage",
+			engine: Engine{Default: defaultRates, FeePercent: 10},
+			want:   Quote{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.engine.Quote(tt.rates, tt.usage); got != tt.want {
+				t.Fatalf("Quote = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEngineSplit(t *testing.T) {
+	tests := []struct {
+		feePercent float64
+		total      int64
+		want       Quote
+	}{
+		{10, 110, Quote{Reward: 100, Fee: 10, Total: 110}},
+		{10, 11, Quote{Reward: 10, Fee: 1, Total: 11}},
+		{10, 17, Quote{Reward: 15, Fee: 2, Total: 17}}, // the fee rounds up, as in Quote
+		{10, 1, Quote{Reward: 0, Fee: 1, Total: 1}},
+		{10, 0, Quote{}},
+		{0, 50, Quote{Reward: 50, Fee: 0, Total: 50}},
+		{100, 30, Quote{Reward: 15, Fee: 15, Total: 30}},
+		{100, 31, Quote{Reward: 15, Fee: 16, Total: 31}},
+	}
+	for _, tt := range tests {
+		got := Engine{FeePercent: tt.feePercent}.Split(tt.total)
+		if got != tt.want {
+			t.Errorf("Split(%d) at %g%% = %+v, want %+v", tt.total, tt.feePercent, got, tt.want)
+		}
+		if got.Reward+got.Fee != got.Total {
+			t.Errorf("Split(%d) at %g%%: reward and fee do not add up to the total", tt.total, tt.feePercent)
+		}
+	}
+
+	// Splitting a quote's total gives the quote back
+	e := Engine{Default: defaultRates, FeePercent: 10}
+	for secs := 0.0; secs <= 36000; secs += 97 {
+		q := e.Quote(billing.Tariff{}, billing.Usage{CPUSeconds: secs})
+		if got := e.Split(q.Total); got != q {
+			t.Fatalf("Split(%d) = %+v, want the quote %+v", q.Total, got, q)
+		}
+	}
+}
+
+func TestEngineCap(t *testing.T) {
+	e := Engine{Default: defaultRates, FeePercent: 10}
+	q := Quote{Reward: 100, Fee: 10, Total: 110}
+
+	tests := []struct {
+		name   string
+		engine Engine
+		quote  Quote
+		cap    int64
+		want   Quote
+	}{
+		{"below the cap", e, q, 200, q},
+		{"at the cap", e, q, 110, q},
+		{"above the cap", e, q, 55, Quote{Reward: 50, Fee: 5, Total: 55}},
+		{"just above the cap", e, q, 109, Quote{Reward: 99, Fee: 10, Total: 109}},
+		{"cap of zero", e, q, 0, Quote{}},
+		{"negative cap", e, q, -5, Quote{}},
+		{"fee of 100%", Engine{FeePercent: 100}, Quote{Reward: 15, Fee: 15, Total: 30}, 10, Quote{Reward: 5, Fee: 5, Total: 10}},
+		{"no fee", Engine{}, Quote{Reward: 15, Total: 15}, 10, Quote{Reward: 10, Total: 10}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.engine.Cap(tt.quote, tt.cap); got != tt.want {
+				t.Fatalf("Cap(%+v, %d) = %+v, want %+v", tt.quote, tt.cap, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEngineRates(t *testing.T) {
+	e := Engine{Default: defaultRates}
+	if got := e.Rates(billing.Tariff{}); got != defaultRates {
+		t.Errorf("Rates of a provider advertising none = %+v, want the default", got)
+	}
+	advertised := billing.Tariff{MemoryGBHour: 3}
+	if got := e.Rates(advertised); got != advertised {
+		t.Errorf("Rates = %+v, want the advertised %+v", got, advertised)
+	}
+}
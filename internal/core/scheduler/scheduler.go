@@ -0,0 +1,197 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+
+	"github.com/gridforce/core/internal/core/billing"
+)
+
+// Policy Names
+const (
+	PolicyLeastLoaded   = "least-loaded"
+	PolicyBestBenchmark = "best-benchmark"
+	PolicyBinPacking    = "bin-packing"
+	PolicyRandom        = "random"
+	PolicyCheapest      = "cheapest"
+)
+
+// ErrNoCandidate is returned when no provider can satisfy a job's requirements
+var ErrNoCandidate = errors.New("no provider satisfies job requirements")
+
+// Requirements describes what a job needs from the provider it runs on
+type Requirements struct {
+	MinCores          int    // CPU cores the job needs free on the provider
+	Platform          string // "os/arch", e.g. linux/arm64; empty matches any
+	MinBenchmarkScore int
+
+	// Sandbox relaxations the job needs
+	Network        bool
+	WritableRootfs bool
+	RunAsRoot      bool
+
+	// Exclude lists providers that declined the job; it goes to the next best candidate
+	Exclude []string
+
+	// MaxPrice is the most the job may cost, compared against each candidate's Price; 0
+	// accepts any price
+	MaxPrice int64
+}
+
+// Candidate is a snapshot of a connected provider offered to a Scheduler
+type Candidate struct {
+	ID             string
+	OS             string
+	Arch           string
+	CpuCores       int
+	UsedCores      int
+	BenchmarkScore int
+	ActiveJobs     int
+	Slots          int
+
+	// Sandbox relaxations the provider accepts
+	AllowNetwork        bool
+	AllowWritableRootfs bool
+	AllowRoot           bool
+
+	// Rates the provider charges, and Price, what the job being placed would cost on it at
+	// most. Price is set per job by the caller.
+	Rates billing.Tariff
+	Price int64
+}
+
+// FreeCores returns the cores not claimed by jobs already running on the candidate
+func (c *Candidate) FreeCores() int {
+	return c.CpuCores - c.UsedCores
+}
+
+// Scheduler chooses which provider a job is placed on
+type Scheduler interface {
+	// Select returns the chosen candidate, or ErrNoCandidate if none satisfies req
+	Select(req Requirements, candidates []Candidate) (*Candidate, error)
+}
+
+// New returns the built-in scheduler registered under the given policy name
+func New(policy string) (Scheduler, error) {
+	switch policy {
+	case PolicyLeastLoaded, "":
+		return LeastLoaded{}, nil
+	case PolicyBestBenchmark:
+		return BestBenchmark{}, nil
+	case PolicyBinPacking:
+		return BinPacking{}, nil
+	case PolicyRandom:
+		return Random{}, nil
+	case PolicyCheapest:
+		return Cheapest{}, nil
+	}
+	return nil, fmt.Errorf("unknown scheduler policy %q", policy)
+}
+
+// Satisfies reports whether a candidate can take a job with the given requirements right now
+func Satisfies(req Requirements, c *Candidate) bool {
+	if slices.Contains(req.Exclude, c.ID) {
+		return false
+	}
+	if req.MaxPrice > 0 && c.Price > req.MaxPrice {
+		return false
+	}
+	if c.ActiveJobs >= c.Slots {
+		return false
+	}
+	cores := req.MinCores
+	if cores < 1 {
+		cores = 1
+	}
+	if c.FreeCores() < cores {
+		return false
+	}
+	if req.Platform != "" && !strings.EqualFold(req.Platform, c.OS+"/"+c.Arch) {
+		return false
+	}
+	if (req.Network && !c.AllowNetwork) || (req.WritableRootfs && !c.AllowWritableRootfs) || (req.RunAsRoot && !c.AllowRoot) {
+		return false
+	}
+	return c.BenchmarkScore >= req.MinBenchmarkScore
+}
+
+// eligible filters candidates down to those that satisfy req
+func eligible(req Requirements, candidates []Candidate) []*Candidate {
+	var out []*Candidate
+	for i := range candidates {
+		if Satisfies(req, &candidates[i]) {
+			out = append(out, &candidates[i])
+		}
+	}
+	return out
+}
+
+// best returns the eligible candidate that ranks lowest under less
+func best(req Requirements, candidates []Candidate, less func(a, b *Candidate) bool) (*Candidate, error) {
+	var chosen *Candidate
+	for _, c := range eligible(req, candidates) {
+		if chosen == nil || less(c, chosen) {
+			chosen = c
+		}
+	}
+	if chosen == nil {
+		return nil, ErrNoCandidate
+	}
+	return chosen, nil
+}
+
+// LeastLoaded places jobs on the provider with the smallest share of its cores in use
+type LeastLoaded struct{}
+
+func (LeastLoaded) Select(req Requirements, candidates []Candidate) (*Candidate, error) {
+	return best(req, candidates, func(a, b *Candidate) bool {
+		// Compare UsedCores/CpuCores without floating point
+		return a.UsedCores*b.CpuCores < b.UsedCores*a.CpuCores
+	})
+}
+
+// BestBenchmark places jobs on the fastest provider by benchmark score
+type BestBenchmark struct{}
+
+func (BestBenchmark) Select(req Requirements, candidates []Candidate) (*Candidate, error) {
+	return best(req, candidates, func(a, b *Candidate) bool {
+		return a.BenchmarkScore > b.BenchmarkScore
+	})
+}
+
+// BinPacking places jobs on the provider left with the fewest free cores after placement,
+// keeping large providers available for large jobs
+type BinPacking struct{}
+
+func (BinPacking) Select(req Requirements, candidates []Candidate) (*Candidate, error) {
+	return best(req, candidates, func(a, b *Candidate) bool {
+		return a.FreeCores() < b.FreeCores()
+	})
+}
+
+// Cheapest places jobs on the provider where they cost the least, preferring the less
+// loaded one between equally priced providers
+type Cheapest struct{}
+
+func (Cheapest) Select(req Requirements, candidates []Candidate) (*Candidate, error) {
+	return best(req, candidates, func(a, b *Candidate) bool {
+		if a.Price != b.Price {
+			return a.Price < b.Price
+		}
+		return a.UsedCores*b.CpuCores < b.UsedCores*a.CpuCores
+	})
+}
+
+// Random places jobs on a uniformly chosen eligible provider
+type Random struct{}
+
+func (Random) Select(req Requirements, candidates []Candidate) (*Candidate, error) {
+	pool := eligible(req, candidates)
+	if len(pool) == 0 {
+		return nil, ErrNoCandidate
+	}
+	return pool[rand.IntN(len(pool))], nil
+}
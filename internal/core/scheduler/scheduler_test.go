@@ -0,0 +1,125 @@
+package scheduler
+
+import (
+	"errors"
+	"testing"
+)
+
+// node returns a linux/amd64 candidate with one free slot
+func node(id string, cores, used, score int) Candidate {
+	return Candidate{ID: id, OS: "linux", Arch: "amd64", CpuCores: cores, UsedCores: used, BenchmarkScore: score, Slots: 1}
+}
+
+func TestSatisfies(t *testing.T) {
+	tests := []struct {
+		name string
+		req  Requirements
+		edit func(c *Candidate)
+		want bool
+	}{
+		{"no requirements", Requirements{}, nil, true},
+		{"enough free cores", Requirements{MinCores: 2}, nil, true},
+		{"too few free cores", Requirements{MinCores: 3}, nil, false},
+		{"no free core", Requirements{}, func(c *Candidate) { c.UsedCores = 4 }, false},
+		{"no free slot", Requirements{}, func(c *Candidate) { c.ActiveJobs = 1 }, false},
+		{"platform matches", Requirements{Platform: "Linux/AMD64"}, nil, true},
+		{"platform differs", Requirements{Platform: "linux/arm64"}, nil, false},
+		{"benchmark met", Requirements{MinBenchmarkScore: 100}, nil, true},
+		{"benchmark too low", Requirements{MinBenchmarkScore: 101}, nil, false},
+		{"network refused", Requirements{Network: true}, nil, false},
+		{"network allowed", Requirements{Network: true}, func(c *Candidate) { c.AllowNetwork = true }, true},
+		{"writable rootfs refused", Requirements{WritableRootfs: true}, nil, false},
+		{"root refused", Requirements{RunAsRoot: true}, nil, false},
+		{"root allowed", Requirements{RunAsRoot: true}, func(c *Candidate) { c.AllowRoot = true }, true},
+		{"excluded", Requirements{Exclude: []string{"other", "n1"}}, nil, false},
+		{"within max price", Requirements{MaxPrice: 50}, func(c *Candidate) { c.Price = 50 }, true},
+		{"over max price", Requirements{MaxPrice: 50}, func(c *Candidate) { c.Price = 51 }, false},
+		{"no max price", Requirements{}, func(c *Candidate) { c.Price = 1 << 40 }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := node("n1", 4, 2, 100)
+			if tt.edit != nil {
+				tt.edit(&c)
+			}
+			if got := Satisfies(tt.req, &c); got != tt.want {
+				t.Fatalf("Satisfies = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	candidates := func() []Candidate {
+		busy := node("busy", 8, 6, 900)  // 75% used, fastest, 2 free
+		idle := node("idle", 16, 4, 300) // 25% used, 12 free
+		snug := node("snug", 5, 2, 500)  // 40% used, 3 free
+		arm := node("arm", 64, 0, 1000)  // idle and fastest, but the wrong platform
+		arm.Arch = "arm64"
+		busy.Price, idle.Price, snug.Price, arm.Price = 30, 20, 20, 1
+		return []Candidate{busy, idle, snug, arm}
+	}
+	req := Requirements{MinCores: 2, Platform: "linux/amd64"}
+
+	tests := []struct {
+		policy string
+		want   string
+	}{
+		{PolicyLeastLoaded, "idle"},
+		{PolicyBestBenchmark, "busy"},
+		{PolicyBinPacking, "busy"},
+		{PolicyCheapest, "idle"}, // tied with snug on price, but less loaded
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			s, err := New(tt.policy)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			got, err := s.Select(req, candidates())
+			if err != nil {
+				t.Fatalf("Select: %v", err)
+			}
+			if got.ID != tt.want {
+				t.Fatalf("Select chose %s, want %s", got.ID, tt.want)
+			}
+		})
+	}
+
+	t.Run(PolicyRandom, func(t *testing.T) {
+		for i := 0; i < 50; i++ {
+			got, err := Random{}.Select(req, candidates())
+			if err != nil {
+				t.Fatalf("Select: %v", err)
+			}
+			if got.ID == "arm" {
+				t.Fatal("Select chose a candidate on the wrong platform")
+			}
+		}
+	})
+}
+
+func TestSelectNoCandidate(t *testing.T) {
+	req := Requirements{MinCores: 32}
+	for _, policy := range []string{PolicyLeastLoaded, PolicyBestBenchmark, PolicyBinPacking, PolicyRandom, PolicyCheapest} {
+		s, err := New(policy)
+		if err != nil {
+			t.Fatalf("New(%q): %v", policy, err)
+		}
+		if _, err := s.Select(req, []Candidate{node("n1", 8, 0, 100)}); !errors.Is(err, ErrNoCandidate) {
+			t.Errorf("%s: Select error = %v, want ErrNoCandidate", policy, err)
+		}
+		if _, err := s.Select(Requirements{}, nil); !errors.Is(err, ErrNoCandidate) {
+			t.Errorf("%s: Select without candidates error = %v, want ErrNoCandidate", policy, err)
+		}
+	}
+}
+
+func TestNewUnknownPolicy(t *testing.T) {
+	if _, err := New("fastest-first"); err == nil {
+		t.Fatal("New accepted an unknown policy")
+	}
+	if s, err := New(""); err != nil || s != (LeastLoaded{}) {
+		t.Fatalf("New(\"\") = %v, %v; want LeastLoaded", s, err)
+	}
+}
@@ -3,8 +3,10 @@ package container
 import (
 	"bytes"
 	"context"
+	"errors"
 	"io"
 	"log"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
@@ -12,67 +14,265 @@ import (
 	"github.com/docker/docker/pkg/stdcopy"
 )
 
-// RunContainer pulls an image (if needed), runs a container, waits for it, and returns logs.
-func RunContainer(ctx context.Context, imageName string, cmd []string) (string, error) {
+// maxOutputBytes caps how much of each output stream is kept per job
+const maxOutputBytes = 1 << 20
+
+// logDrainTimeout bounds how long RunContainer waits for the log stream to end after the container stops
+const logDrainTimeout = 5 * time.Second
+
+// Output Streams
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+)
+
+// LogFunc receives container output as it is produced. Calls are made from a single goroutine.
+type LogFunc func(stream, data string)
+
+var (
+	// ErrOOMKilled is returned when the kernel killed the container for exceeding its memory limit
+	ErrOOMKilled = errors.New("container killed: out of memory")
+	// ErrTimeout is returned when the container outlived its wall-clock timeout
+	ErrTimeout = errors.New("container killed: timeout exceeded")
+)
+
+// Limits caps the resources a single container may consume. Zero values mean unlimited.
+type Limits struct {
+	CPUs         float64
+	MemoryBytes  int64
+	PidsLimit    int64
+	ShmSizeBytes int64
+	Timeout      time.Duration
+}
+
+// Result describes a finished container run
+type Result struct {
+	ExitCode        int
+	Stdout          string
+	Stderr          string
+	StdoutTruncated bool
+	StderrTruncated bool
+	ImageDigest     string
+	PulledAt        time.Time
+	StartedAt       time.Time
+	FinishedAt      time.Time
+	Usage           Usage
+}
+
+// cappedBuffer keeps the first max bytes written to it and records whether anything was dropped
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.buf.Len(); len(p) > room {
+		b.truncated = true
+		if room > 0 {
+			b.buf.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+// logWriter forwards output to a LogFunc as it arrives while keeping a capped copy for the result
+type logWriter struct {
+	cappedBuffer
+	stream string
+	onLog  LogFunc
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	if w.onLog != nil && len(p) > 0 {
+		w.onLog(w.stream, string(p))
+	}
+	return w.cappedBuffer.Write(p)
+}
+
+// hostConfig translates Limits into Docker's HostConfig
+func (l Limits) hostConfig() *container.HostConfig {
+	hc := &container.HostConfig{
+		Resources: container.Resources{
+			NanoCPUs: int64(l.CPUs * 1e9),
+			Memory:   l.MemoryBytes,
+		},
+		ShmSize: l.ShmSizeBytes,
+	}
+	if l.MemoryBytes > 0 {
+		// Disallow swap so the memory limit is a hard limit
+		hc.Resources.MemorySwap = l.MemoryBytes
+	}
+	if l.PidsLimit > 0 {
+		pids := l.PidsLimit
+		hc.Resources.PidsLimit = &pids
+	}
+	return hc
+}
+
+// RunContainer pulls an image (if needed), runs a sandboxed container within limits, waits for it, and
+// returns its result. The image, sandbox and limits must be allowed by the provider's policy. Output is passed to onLog
+// (if set) while the container runs. When the container was killed (timeout, OOM) both the partial
+// result and the error are returned.
+func RunContainer(ctx context.Context, imageName string, cmd []string, limits Limits, sandbox Sandbox, policy Policy, onLog LogFunc) (*Result, error) {
+	if err := policy.Check(sandbox); err != nil {
+		return nil, err
+	}
+	if err := policy.CheckImage(imageName); err != nil {
+		return nil, err
+	}
+	limits, err := policy.Cap(limits)
+	if err != nil {
+		return nil, err
+	}
+
 	// Initialize Docker client with fixed API version 1.44 as requested
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithVersion("1.44"))
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer cli.Close()
 
+	result := &Result{}
+
 	// 1. Pull Image
 	log.Printf("Pulling image %s...\n", imageName)
 	reader, err := cli.ImagePull(ctx, imageName, types.ImagePullOptions{})
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	io.Copy(io.Discard, reader) // Consume pull output
 	reader.Close()
+	result.PulledAt = time.Now()
+
+	// Record exactly which image ran
+	if inspect, _, err := cli.ImageInspectWithRaw(ctx, imageName); err == nil {
+		result.ImageDigest = inspect.ID
+		if len(inspect.RepoDigests) > 0 {
+			result.ImageDigest = inspect.RepoDigests[0]
+		}
+	}
 
 	// 2. Create Container
-	resp, err := cli.ContainerCreate(ctx, &container.Config{
+	config := &container.Config{
 		Image: imageName,
 		Cmd:   cmd,
-	}, nil, nil, nil, "")
+	}
+	hostConfig := limits.hostConfig()
+	policy.apply(sandbox, config, hostConfig)
+
+	resp, err := cli.ContainerCreate(ctx, config, hostConfig, nil, nil, "")
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	containerID := resp.ID
 	defer func() {
-		// 6. Cleanup
-		if err := cli.ContainerRemove(ctx, containerID, types.ContainerRemoveOptions{}); err != nil {
+		// 7. Cleanup (ctx may already be done, so use a fresh one)
+		if err := cli.ContainerRemove(context.Background(), containerID, types.ContainerRemoveOptions{Force: true}); err != nil {
 			log.Printf("Failed to remove container %s: %v\n", containerID, err)
 		}
 	}()
 
+	// The wall-clock timeout only covers execution, not the image pull
+	runCtx := ctx
+	if limits.Timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, limits.Timeout)
+		defer cancel()
+	}
+
 	// 3. Start Container
-	if err := cli.ContainerStart(ctx, containerID, types.ContainerStartOptions{}); err != nil {
-		return "", err
+	if err := cli.ContainerStart(runCtx, containerID, types.ContainerStartOptions{}); err != nil {
+		// A deadline that expires while starting is still the job's timeout
+		if errors.Is(runCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+			return nil, ErrTimeout
+		}
+		return nil, err
 	}
+	result.StartedAt = time.Now()
 
-	// 4. Wait for completion
-	statusCh, errCh := cli.ContainerWait(ctx, containerID, container.WaitConditionNotRunning)
+	// Meter CPU and memory while the container runs
+	meter := &usageMeter{}
+	statsCtx, stopStats := context.WithCancel(context.Background())
+	statsDone := make(chan struct{})
+	go func() {
+		defer close(statsDone)
+		meter.follow(statsCtx, cli, containerID)
+	}()
+	defer func() {
+		stopStats()
+		<-statsDone
+	}()
+
+	// 4. Follow Logs until the container stops
+	logCtx, stopLogs := context.WithCancel(context.Background())
+	defer stopLogs()
+	stdout := &logWriter{cappedBuffer: cappedBuffer{max: maxOutputBytes}, stream: StreamStdout, onLog: onLog}
+	stderr := &logWriter{cappedBuffer: cappedBuffer{max: maxOutputBytes}, stream: StreamStderr, onLog: onLog}
+	logsDone := make(chan error, 1)
+	go func() {
+		out, err := cli.ContainerLogs(logCtx, containerID, types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true, Follow: true})
+		if err != nil {
+			logsDone <- err
+			return
+		}
+		defer out.Close()
+		_, err = stdcopy.StdCopy(stdout, stderr, out)
+		logsDone <- err
+	}()
+
+	// 5. Wait for completion
+	var runErr error
+	statusCh, errCh := cli.ContainerWait(runCtx, containerID, container.WaitConditionNotRunning)
 	select {
 	case err := <-errCh:
 		if err != nil {
-			return "", err
+			if !errors.Is(runCtx.Err(), context.DeadlineExceeded) || ctx.Err() != nil {
+				return nil, err
+			}
+			runErr = ErrTimeout
+			if err := cli.ContainerKill(context.Background(), containerID, "SIGKILL"); err != nil {
+				log.Printf("Failed to kill container %s: %v\n", containerID, err)
+			}
 		}
-	case <-statusCh:
+	case status := <-statusCh:
+		result.ExitCode = int(status.StatusCode)
 	}
+	result.FinishedAt = time.Now()
+	stopStats()
+	<-statsDone
+	result.Usage = meter.usage(result.StartedAt, result.FinishedAt)
 
-	// 5. Get Logs
-	out, err := cli.ContainerLogs(ctx, containerID, types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true})
+	// 6. Detect OOM kills and read the final exit code
+	inspect, err := cli.ContainerInspect(context.Background(), containerID)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if inspect.State != nil {
+		result.ExitCode = inspect.State.ExitCode
+		if runErr == nil && inspect.State.OOMKilled {
+			runErr = ErrOOMKilled
+		}
 	}
-	defer out.Close()
 
-	var stdout, stderr bytes.Buffer
-	if _, err := stdcopy.StdCopy(&stdout, &stderr, out); err != nil {
-		return "", err
+	// Let the log stream drain (also after a kill, so partial output is not lost)
+	select {
+	case err := <-logsDone:
+		if err != nil {
+			log.Printf("Log stream for container %s ended early: %v\n", containerID, err)
+		}
+	case <-time.After(logDrainTimeout):
+		log.Printf("Log stream for container %s did not end, closing it\n", containerID)
+		stopLogs()
+		<-logsDone
 	}
 
-	return stdout.String(), nil
+	result.Stdout = stdout.buf.String()
+	result.Stderr = stderr.buf.String()
+	result.StdoutTruncated = stdout.truncated
+	result.StderrTruncated = stderr.truncated
+
+	return result, runErr
 }
@@ -0,0 +1,151 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types/container"
+)
+
+const (
+	// sandboxUser is the unprivileged uid:gid (nobody) jobs run as unless they need root
+	sandboxUser = "65534:65534"
+	// scratchMount is the writable tmpfs available to jobs on a read-only root filesystem
+	scratchMount   = "/tmp"
+	scratchOptions = "rw,noexec,nosuid,nodev,size=256m"
+)
+
+// ErrPolicyViolation is returned when a job needs more than the provider's policy allows
+var ErrPolicyViolation = errors.New("sandbox policy violation")
+
+// Sandbox lists the relaxations of the hardened profile a job needs.
+// The zero value is the strictest profile: no network, read-only rootfs, non-root user.
+type Sandbox struct {
+	Network        bool
+	WritableRootfs bool
+	RunAsRoot      bool
+}
+
+// Policy is the most permissive sandbox a provider is willing to run
+type Policy struct {
+	Allow          Sandbox
+	SeccompProfile string // JSON profile contents; empty keeps Docker's default profile
+	// MaxLimits caps what a single job may ask for; zero fields are uncapped
+	MaxLimits Limits
+	// AllowedRegistries lists the registries images may come from (e.g. "docker.io",
+	// "ghcr.io"); empty allows any registry
+	AllowedRegistries []string
+}
+
+// LoadSeccompProfile reads a seccomp JSON profile from disk into the policy
+func (p *Policy) LoadSeccompProfile(path string) error {
+	profile, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read seccomp profile: %v", err)
+	}
+	p.SeccompProfile = string(profile)
+	return nil
+}
+
+// Check returns ErrPolicyViolation if the sandbox asks for anything the policy does not allow
+func (p Policy) Check(sb Sandbox) error {
+	if sb.Network && !p.Allow.Network {
+		return fmt.Errorf("%w: network egress not allowed", ErrPolicyViolation)
+	}
+	if sb.WritableRootfs && !p.Allow.WritableRootfs {
+		return fmt.Errorf("%w: writable root filesystem not allowed", ErrPolicyViolation)
+	}
+	if sb.RunAsRoot && !p.Allow.RunAsRoot {
+		return fmt.Errorf("%w: running as root not allowed", ErrPolicyViolation)
+	}
+	return nil
+}
+
+// CheckImage returns ErrPolicyViolation if the image does not come from an allowed registry.
+// Short names like "alpine" resolve to docker.io.
+func (p Policy) CheckImage(image string) error {
+	if len(p.AllowedRegistries) == 0 {
+		return nil
+	}
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return fmt.Errorf("%w: invalid image reference %q", ErrPolicyViolation, image)
+	}
+	registry := reference.Domain(named)
+	for _, allowed := range p.AllowedRegistries {
+		if registry == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: registry %s not allowed", ErrPolicyViolation, registry)
+}
+
+// Cap applies the policy's resource caps to a job's limits. Limits the job leaves unset get
+// the cap; limits above the cap are a policy violation.
+func (p Policy) Cap(l Limits) (Limits, error) {
+	caps := p.MaxLimits
+	if caps.CPUs > 0 {
+		if l.CPUs > caps.CPUs {
+			return l, fmt.Errorf("%w: %.2f CPUs requested, at most %.2f allowed", ErrPolicyViolation, l.CPUs, caps.CPUs)
+		}
+		if l.CPUs == 0 {
+			l.CPUs = caps.CPUs
+		}
+	}
+	if caps.MemoryBytes > 0 {
+		if l.MemoryBytes > caps.MemoryBytes {
+			return l, fmt.Errorf("%w: %d bytes of memory requested, at most %d allowed", ErrPolicyViolation, l.MemoryBytes, caps.MemoryBytes)
+		}
+		if l.MemoryBytes == 0 {
+			l.MemoryBytes = caps.MemoryBytes
+		}
+	}
+	if caps.PidsLimit > 0 {
+		if l.PidsLimit > caps.PidsLimit {
+			return l, fmt.Errorf("%w: %d processes requested, at most %d allowed", ErrPolicyViolation, l.PidsLimit, caps.PidsLimit)
+		}
+		if l.PidsLimit == 0 {
+			l.PidsLimit = caps.PidsLimit
+		}
+	}
+	if caps.ShmSizeBytes > 0 {
+		if l.ShmSizeBytes > caps.ShmSizeBytes {
+			return l, fmt.Errorf("%w: %d bytes of shared memory requested, at most %d allowed", ErrPolicyViolation, l.ShmSizeBytes, caps.ShmSizeBytes)
+		}
+		if l.ShmSizeBytes == 0 {
+			l.ShmSizeBytes = caps.ShmSizeBytes
+		}
+	}
+	if caps.Timeout > 0 {
+		if l.Timeout > caps.Timeout {
+			return l, fmt.Errorf("%w: timeout of %s requested, at most %s allowed", ErrPolicyViolation, l.Timeout, caps.Timeout)
+		}
+		if l.Timeout == 0 {
+			l.Timeout = caps.Timeout
+		}
+	}
+	return l, nil
+}
+
+// apply hardens the container configuration, relaxing only what the sandbox asks for
+func (p Policy) apply(sb Sandbox, cfg *container.Config, hc *container.HostConfig) {
+	hc.CapDrop = []string{"ALL"}
+	hc.SecurityOpt = append(hc.SecurityOpt, "no-new-privileges:true")
+	if p.SeccompProfile != "" {
+		hc.SecurityOpt = append(hc.SecurityOpt, "seccomp="+p.SeccompProfile)
+	}
+
+	if !sb.Network {
+		cfg.NetworkDisabled = true
+		hc.NetworkMode = "none"
+	}
+	if !sb.WritableRootfs {
+		hc.ReadonlyRootfs = true
+		hc.Tmpfs = map[string]string{scratchMount: scratchOptions}
+	}
+	if !sb.RunAsRoot {
+		cfg.User = sandboxUser
+	}
+}
@@ -0,0 +1,145 @@
+package container
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+func TestPolicyCap(t *testing.T) {
+	policy := Policy{MaxLimits: Limits{
+		CPUs:         2,
+		MemoryBytes:  512 << 20,
+		PidsLimit:    100,
+		ShmSizeBytes: 64 << 20,
+		Timeout:      time.Minute,
+	}}
+
+	tests := []struct {
+		name    string
+		policy  Policy
+		limits  Limits
+		want    Limits
+		wantErr bool
+	}{
+		{
+			name:   "unset limits get the caps",
+			policy: policy,
+			want:   policy.MaxLimits,
+		},
+		{
+			name:   "limits within the caps are kept",
+			policy: policy,
+			limits: Limits{CPUs: 0.5, MemoryBytes: 128 << 20, PidsLimit: 10, ShmSizeBytes: 16 << 20, Timeout: time.Second},
+			want:   Limits{CPUs: 0.5, MemoryBytes: 128 << 20, PidsLimit: 10, ShmSizeBytes: 16 << 20, Timeout: time.Second},
+		},
+		{
+			name:   "limits equal to the caps are kept",
+			policy: policy,
+			limits: policy.MaxLimits,
+			want:   policy.MaxLimits,
+		},
+		{
+			name:   "uncapped policy leaves limits alone",
+			limits: Limits{CPUs: 64, ShmSizeBytes: 1 << 30},
+			want:   Limits{CPUs: 64, ShmSizeBytes: 1 << 30},
+		},
+		{name: "too many CPUs", policy: policy, limits: Limits{CPUs: 2.5}, wantErr: true},
+		{name: "too much memory", policy: policy, limits: Limits{MemoryBytes: 1 << 30}, wantErr: true},
+		{name: "too many processes", policy: policy, limits: Limits{PidsLimit: 101}, wantErr: true},
+		{name: "too much shared memory", policy: policy, limits: Limits{ShmSizeBytes: 64<<20 + 1}, wantErr: true},
+		{name: "timeout too long", policy: policy, limits: Limits{Timeout: time.Hour}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.policy.Cap(tt.limits)
+			if tt.wantErr {
+				if !errors.Is(err, ErrPolicyViolation) {
+					t.Fatalf("Cap error = %v, want ErrPolicyViolation", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Cap: %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("Cap = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicyCheckImage(t *testing.T) {
+	policy := Policy{AllowedRegistries: []string{"docker.io", "ghcr.io"}}
+	tests := []struct {
+		image   string
+		allowed bool
+	}{
+		{"alpine", true},
+		{"library/alpine:3.19", true},
+		{"docker.io/library/python:3.12", true},
+		{"ghcr.io/gridforce/bench@sha256:" + "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", true},
+		{"quay.io/prometheus/busybox", false},
+		{"registry.example.com:5000/tools/job", false},
+		{"evil.io/docker.io/alpine", false},
+		{"Not A Valid Reference", false},
+	}
+	for _, tt := range tests {
+		err := policy.CheckImage(tt.image)
+		if tt.allowed && err != nil {
+			t.Errorf("CheckImage(%q): %v", tt.image, err)
+		}
+		if !tt.allowed && !errors.Is(err, ErrPolicyViolation) {
+			t.Errorf("CheckImage(%q) error = %v, want ErrPolicyViolation", tt.image, err)
+		}
+	}
+
+	if err := (Policy{}).CheckImage("quay.io/prometheus/busybox"); err != nil {
+		t.Errorf("policy without registries refused an image: %v", err)
+	}
+}
+
+func TestPolicyCheck(t *testing.T) {
+	strict := Policy{}
+	for _, sb := range []Sandbox{{Network: true}, {WritableRootfs: true}, {RunAsRoot: true}} {
+		if err := strict.Check(sb); !errors.Is(err, ErrPolicyViolation) {
+			t.Errorf("Check(%+v) error = %v, want ErrPolicyViolation", sb, err)
+		}
+	}
+	if err := strict.Check(Sandbox{}); err != nil {
+		t.Errorf("Check of the strictest sandbox: %v", err)
+	}
+
+	relaxed := Policy{Allow: Sandbox{Network: true, WritableRootfs: true, RunAsRoot: true}}
+	if err := relaxed.Check(Sandbox{Network: true, WritableRootfs: true, RunAsRoot: true}); err != nil {
+		t.Errorf("Check against a relaxed policy: %v", err)
+	}
+}
+
+func TestPolicyApply(t *testing.T) {
+	cfg, hc := &container.Config{}, &container.HostConfig{}
+	Policy{}.apply(Sandbox{}, cfg, hc)
+	if !cfg.NetworkDisabled || hc.NetworkMode != "none" {
+		t.Error("network left enabled")
+	}
+	if !hc.ReadonlyRootfs || hc.Tmpfs[scratchMount] == "" {
+		t.Error("root filesystem left writable or without scratch space")
+	}
+	if cfg.User != sandboxUser {
+		t.Errorf("user = %q, want %q", cfg.User, sandboxUser)
+	}
+	if len(hc.CapDrop) != 1 || hc.CapDrop[0] != "ALL" {
+		t.Errorf("CapDrop = %v, want [ALL]", hc.CapDrop)
+	}
+
+	cfg, hc = &container.Config{}, &container.HostConfig{}
+	Policy{}.apply(Sandbox{Network: true, WritableRootfs: true, RunAsRoot: true}, cfg, hc)
+	if cfg.NetworkDisabled || hc.ReadonlyRootfs || cfg.User != "" {
+		t.Errorf("relaxations not applied: %+v %+v", cfg, hc)
+	}
+	if len(hc.CapDrop) != 1 || hc.CapDrop[0] != "ALL" {
+		t.Errorf("capabilities kept for a relaxed sandbox: %v", hc.CapDrop)
+	}
+}
@@ -0,0 +1,73 @@
+package container
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+// Usage is what a container consumed while it ran
+type Usage struct {
+	CPUSeconds      float64 // core-seconds of CPU time
+	MemoryGBSeconds float64 // memory in use, in GB, integrated over the run
+	WallSeconds     float64
+}
+
+// usageMeter follows a container's stats stream (about one sample per second) and
+// accumulates its CPU time and memory use
+type usageMeter struct {
+	mu       sync.Mutex
+	cpuNanos uint64    // cumulative CPU time at the last sample
+	memBytes uint64    // memory in use at the last sample
+	lastRead time.Time // time of the last sample
+	gbSecs   float64   // memory integrated up to lastRead
+}
+
+// follow reads stats until the stream ends or ctx is done
+func (m *usageMeter) follow(ctx context.Context, cli *client.Client, containerID string) {
+	stats, err := cli.ContainerStats(ctx, containerID, true)
+	if err != nil {
+		return
+	}
+	defer stats.Body.Close()
+
+	dec := json.NewDecoder(stats.Body)
+	for {
+		var sample types.StatsJSON
+		if err := dec.Decode(&sample); err != nil {
+			return
+		}
+		// Stopped containers report empty samples
+		if sample.Read.IsZero() || sample.CPUStats.CPUUsage.TotalUsage == 0 {
+			continue
+		}
+		m.mu.Lock()
+		if !m.lastRead.IsZero() && sample.Read.After(m.lastRead) {
+			m.gbSecs += float64(m.memBytes) / (1 << 30) * sample.Read.Sub(m.lastRead).Seconds()
+		}
+		m.cpuNanos = sample.CPUStats.CPUUsage.TotalUsage
+		m.memBytes = sample.MemoryStats.Usage
+		m.lastRead = sample.Read
+		m.mu.Unlock()
+	}
+}
+
+// usage returns the consumption of a run between started and finished. Memory after the
+// last sample is counted at the last sampled level.
+func (m *usageMeter) usage(started, finished time.Time) Usage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := Usage{
+		CPUSeconds:      float64(m.cpuNanos) / 1e9,
+		MemoryGBSeconds: m.gbSecs,
+		WallSeconds:     finished.Sub(started).Seconds(),
+	}
+	if !m.lastRead.IsZero() && finished.After(m.lastRead) {
+		u.MemoryGBSeconds += float64(m.memBytes) / (1 << 30) * finished.Sub(m.lastRead).Seconds()
+	}
+	return u
+}
@@ -0,0 +1,145 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Binary frames carry large values (job outputs) as raw bytes instead of escaped JSON
+// strings. A value is split into a blob of numbered chunks, one per binary frame, sent
+// before the JSON message that refers to the blob by ID. Frame layout:
+//
+//	byte 0      format version (chunkFormat)
+//	byte 1      flags (chunkFinal on the last chunk of a blob)
+//	byte 2      length n of the blob ID
+//	3 .. 3+n    blob ID
+//	next 4      sequence number, big endian, starting at 0
+//	rest        data
+const (
+	chunkFormat = 1
+	chunkFinal  = 1 << 0
+)
+
+// ChunkOverhead is the most a frame adds to the data it carries
+const ChunkOverhead = 3 + 255 + 4
+
+// ErrBadChunk is returned for binary frames that are not valid chunks
+var ErrBadChunk = errors.New("malformed binary chunk")
+
+// Chunk is one binary frame of a blob
+type Chunk struct {
+	BlobID string
+	Seq    uint32
+	Final  bool
+	Data   []byte
+}
+
+// MarshalBinary encodes the chunk as a binary frame
+func (c Chunk) MarshalBinary() ([]byte, error) {
+	if c.BlobID == "" || len(c.BlobID) > 255 {
+		return nil, fmt.Errorf("%w: blob ID must be 1 to 255 bytes", ErrBadChunk)
+	}
+	frame := make([]byte, 0, 3+len(c.BlobID)+4+len(c.Data))
+	var flags byte
+	if c.Final {
+		flags |= chunkFinal
+	}
+	frame = append(frame, chunkFormat, flags, byte(len(c.BlobID)))
+	frame = append(frame, c.BlobID...)
+	frame = binary.BigEndian.AppendUint32(frame, c.Seq)
+	return append(frame, c.Data...), nil
+}
+
+// UnmarshalBinary decodes a binary frame. Data aliases the frame.
+func (c *Chunk) UnmarshalBinary(frame []byte) error {
+	if len(frame) < 3 || frame[0] != chunkFormat {
+		return ErrBadChunk
+	}
+	n := int(frame[2])
+	if n == 0 || len(frame) < 3+n+4 {
+		return ErrBadChunk
+	}
+	c.Final = frame[1]&chunkFinal != 0
+	c.BlobID = string(frame[3 : 3+n])
+	c.Seq = binary.BigEndian.Uint32(frame[3+n:])
+	c.Data = frame[3+n+4:]
+	return nil
+}
+
+// SplitBlob cuts a value into chunks of at most size bytes; an empty value is one empty chunk
+func SplitBlob(blobID string, data []byte, size int) []Chunk {
+	if size < 1 {
+		size = 1
+	}
+	var chunks []Chunk
+	for seq := uint32(0); ; seq++ {
+		n := min(size, len(data))
+		chunks = append(chunks, Chunk{BlobID: blobID, Seq: seq, Data: data[:n], Final: n == len(data)})
+		data = data[n:]
+		if len(data) == 0 {
+			return chunks
+		}
+	}
+}
+
+// blob is a value being reassembled
+type blob struct {
+	data      []byte
+	next      uint32
+	complete  bool
+	truncated bool
+}
+
+// Assembler reassembles blobs from their chunks. It holds at most maxBytes across all blobs
+// not yet taken; data beyond that is dropped and the blob is marked truncated, so a peer
+// cannot make the receiver buffer more than the limit.
+type Assembler struct {
+	maxBytes int64
+	held     int64
+	blobs    map[string]*blob
+}
+
+// NewAssembler returns an assembler holding at most maxBytes
+func NewAssembler(maxBytes int64) *Assembler {
+	return &Assembler{maxBytes: maxBytes, blobs: make(map[string]*blob)}
+}
+
+// Add appends a chunk to its blob. Chunks of a blob must arrive in order.
+func (a *Assembler) Add(c Chunk) error {
+	b := a.blobs[c.BlobID]
+	if b == nil {
+		b = &blob{}
+		a.blobs[c.BlobID] = b
+	}
+	if b.complete {
+		return fmt.Errorf("%w: blob %s already complete", ErrBadChunk, c.BlobID)
+	}
+	if c.Seq != b.next {
+		delete(a.blobs, c.BlobID)
+		a.held -= int64(len(b.data))
+		return fmt.Errorf("%w: blob %s expected chunk %d, got %d", ErrBadChunk, c.BlobID, b.next, c.Seq)
+	}
+	b.next++
+	b.complete = c.Final
+
+	data := c.Data
+	if room := a.maxBytes - a.held; int64(len(data)) > room {
+		data = data[:max(room, 0)]
+		b.truncated = true
+	}
+	b.data = append(b.data, data...)
+	a.held += int64(len(data))
+	return nil
+}
+
+// Take removes a complete blob and returns its data and whether any of it was dropped
+func (a *Assembler) Take(blobID string) ([]byte, bool, error) {
+	b := a.blobs[blobID]
+	if b == nil || !b.complete {
+		return nil, false, fmt.Errorf("blob %s not received", blobID)
+	}
+	delete(a.blobs, blobID)
+	a.held -= int64(len(b.data))
+	return b.data, b.truncated, nil
+}
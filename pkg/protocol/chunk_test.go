@@ -0,0 +1,65 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestChunkRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("line \"quoted\"\n\x00"), 1000)
+	chunks := SplitBlob("blob-1", data, 4096)
+	if len(chunks) != (len(data)+4095)/4096 {
+		t.Fatalf("got %d chunks for %d bytes", len(chunks), len(data))
+	}
+
+	a := NewAssembler(1 << 20)
+	for _, c := range chunks {
+		frame, err := c.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary: %v", err)
+		}
+		var received Chunk
+		if err := received.UnmarshalBinary(frame); err != nil {
+			t.Fatalf("UnmarshalBinary: %v", err)
+		}
+		if err := a.Add(received); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+
+	got, truncated, err := a.Take("blob-1")
+	if err != nil {
+		t.Fatalf("Take: %v", err)
+	}
+	if truncated || !bytes.Equal(got, data) {
+		t.Fatalf("reassembled %d bytes (truncated %t), want %d", len(got), truncated, len(data))
+	}
+	if _, _, err := a.Take("blob-1"); err == nil {
+		t.Fatal("blob taken twice")
+	}
+}
+
+func TestAssemblerLimit(t *testing.T) {
+	a := NewAssembler(10)
+	for _, c := range SplitBlob("big", bytes.Repeat([]byte("x"), 25), 8) {
+		if err := a.Add(c); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+	got, truncated, err := a.Take("big")
+	if err != nil {
+		t.Fatalf("Take: %v", err)
+	}
+	if len(got) != 10 || !truncated {
+		t.Fatalf("got %d bytes (truncated %t), want 10 truncated", len(got), truncated)
+	}
+}
+
+func TestAssemblerOutOfOrder(t *testing.T) {
+	a := NewAssembler(1 << 10)
+	chunks := SplitBlob("b", []byte("abcdef"), 2)
+	if err := a.Add(chunks[1]); !errors.Is(err, ErrBadChunk) {
+		t.Fatalf("out of order chunk: got %v, want ErrBadChunk", err)
+	}
+}
@@ -0,0 +1,97 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// Payload is implemented by every message payload and names the message type it travels in
+type Payload interface {
+	MessageType() string
+}
+
+func (ChallengePayload) MessageType() string  { return TypeChallenge }
+func (AuthPayload) MessageType() string       { return TypeAuth }
+func (HelloPayload) MessageType() string      { return TypeHello }
+func (AckPayload) MessageType() string        { return TypeAck }
+func (ErrorPayload) MessageType() string      { return TypeError }
+func (JobOfferPayload) MessageType() string   { return TypeJobOffer }
+func (JobAcceptPayload) MessageType() string  { return TypeJobAccept }
+func (JobRejectPayload) MessageType() string  { return TypeJobReject }
+func (JobStartedPayload) MessageType() string { return TypeJobStarted }
+func (JobResultPayload) MessageType() string  { return TypeJobResult }
+func (JobLogPayload) MessageType() string     { return TypeJobLog }
+func (JobCancelPayload) MessageType() string  { return TypeJobCancel }
+func (CapacityPayload) MessageType() string   { return TypeCapacity }
+func (HeartbeatPayload) MessageType() string  { return TypeHeartbeat }
+
+// NewID returns a random message ID
+func NewID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Encode wraps a payload in a Message of the payload's type with a fresh ID
+func Encode(payload Payload) (Message, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Message{}, fmt.Errorf("failed to encode %s payload: %v", payload.MessageType(), err)
+	}
+	return Message{Type: payload.MessageType(), ID: NewID(), Payload: data}, nil
+}
+
+// EncodeReply wraps a payload in a Message answering another message
+func EncodeReply(to Message, payload Payload) (Message, error) {
+	msg, err := Encode(payload)
+	msg.ReplyTo = to.ID
+	return msg, err
+}
+
+// Decode unmarshals a message's payload into the payload type for its message type.
+// It fails if the message is of a different type.
+func Decode[T Payload](msg Message) (T, error) {
+	var payload T
+	if msg.Type != payload.MessageType() {
+		return payload, fmt.Errorf("expected %s message, got %s", payload.MessageType(), msg.Type)
+	}
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		return payload, fmt.Errorf("failed to decode %s payload: %v", msg.Type, err)
+	}
+	return payload, nil
+}
+
+// Negotiate picks the protocol version and features to use with a provider, or returns the
+// ERROR payload to reject it with when it does not speak a supported version
+func Negotiate(auth AuthPayload) (HelloPayload, *ErrorPayload) {
+	if auth.Version < MinVersion {
+		return HelloPayload{}, &ErrorPayload{
+			Code:       ErrCodeUnsupportedVersion,
+			Message:    fmt.Sprintf("protocol version %d is not supported, upgrade the provider", auth.Version),
+			MinVersion: MinVersion,
+			MaxVersion: Version,
+		}
+	}
+	hello := HelloPayload{Version: auth.Version, NodeID: auth.DeviceID}
+	if hello.Version > Version {
+		hello.Version = Version
+	}
+	for _, f := range auth.Features {
+		if HasFeature(Features, f) {
+			hello.Features = append(hello.Features, f)
+		}
+	}
+	return hello, nil
+}
+
+// HasFeature reports whether a feature is in a negotiated feature list
+func HasFeature(features []string, feature string) bool {
+	for _, f := range features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
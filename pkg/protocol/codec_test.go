@@ -0,0 +1,172 @@
+package protocol
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// roundTrip encodes a payload, sends it through JSON as it would travel over the wire and
+// decodes it again
+func roundTrip[T Payload](t *testing.T, payload T) {
+	t.Helper()
+
+	msg, err := Encode(payload)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if msg.Type != payload.MessageType() {
+		t.Fatalf("Encode: type %q, want %q", msg.Type, payload.MessageType())
+	}
+
+	wire, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatalf("marshal message: %v", err)
+	}
+	var received Message
+	if err := json.Unmarshal(wire, &received); err != nil {
+		t.Fatalf("unmarshal message: %v", err)
+	}
+
+	decoded, err := Decode[T](received)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, payload) {
+		t.Fatalf("round trip mismatch:\n got  %+v\n want %+v", decoded, payload)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	exitCode := 137
+	started := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run(TypeChallenge, func(t *testing.T) {
+		roundTrip(t, ChallengePayload{Nonce: "6e6f6e6365"})
+	})
+	t.Run(TypeAuth, func(t *testing.T) {
+		roundTrip(t, AuthPayload{
+			DeviceID:        "d3v1ce",
+			WalletAddress:   "0x70997970C51812dc3A010C7d01b50e0d17dc79C8",
+			OS:              "linux",
+			Arch:            "amd64",
+			CpuCores:        8,
+			Signature:       "0x5167",
+			DeviceSignature: "ed25519",
+			Slots:           4,
+			Sandbox:         SandboxSpec{Network: true},
+			Prices:          Prices{CoreHour: 45, MemoryGBHour: 4.5},
+			JobIDs:          []string{"job-1", "job-2"},
+			Version:         Version,
+			Features:        Features,
+		})
+	})
+	t.Run(TypeHello, func(t *testing.T) {
+		roundTrip(t, HelloPayload{Version: Version, Features: []string{FeatureJobLogs}, NodeID: "d3v1ce", MaxMessageSize: 1 << 22})
+	})
+	t.Run(TypeAck, func(t *testing.T) {
+		roundTrip(t, AckPayload{})
+	})
+	t.Run(TypeError, func(t *testing.T) {
+		roundTrip(t, ErrorPayload{Code: ErrCodeUnsupportedVersion, Message: "too old", MinVersion: 1, MaxVersion: 2})
+	})
+	t.Run(TypeJobOffer, func(t *testing.T) {
+		roundTrip(t, JobOfferPayload{
+			JobID:     "job-1",
+			Image:     "alpine:3.19",
+			Cmd:       []string{"echo", "hi"},
+			Resources: ResourceLimits{CPUs: 1.5, MemoryMB: 512, PidsLimit: 64, ShmSizeMB: 64, TimeoutSeconds: 60},
+			Sandbox:   SandboxSpec{WritableRootfs: true, RunAsRoot: true},
+		})
+	})
+	t.Run(TypeJobAccept, func(t *testing.T) {
+		roundTrip(t, JobAcceptPayload{JobID: "job-1"})
+	})
+	t.Run(TypeJobReject, func(t *testing.T) {
+		roundTrip(t, JobRejectPayload{JobID: "job-1", Reason: RejectImageNotAllowed, Message: "registry quay.io not allowed"})
+	})
+	t.Run(TypeJobStarted, func(t *testing.T) {
+		roundTrip(t, JobStartedPayload{JobID: "job-1"})
+	})
+	t.Run(TypeJobResult, func(t *testing.T) {
+		roundTrip(t, JobResultPayload{
+			JobID:           "job-1",
+			ExitCode:        &exitCode,
+			Stdout:          "out",
+			Stderr:          "err",
+			StdoutBlob:      "b10b",
+			StdoutTruncated: true,
+			ImageDigest:     "alpine@sha256:abc",
+			PulledAt:        started.Add(-time.Second),
+			StartedAt:       started,
+			FinishedAt:      started.Add(time.Minute),
+			Error:           "container killed: out of memory",
+			FailureReason:   FailureOOMKilled,
+			Usage:           &Usage{CPUSeconds: 42.5, MemoryGBSeconds: 7.25, WallSeconds: 60},
+		})
+	})
+	t.Run(TypeJobLog, func(t *testing.T) {
+		roundTrip(t, JobLogPayload{JobID: "job-1", Seq: 3, Stream: "stderr", Data: "line\n"})
+	})
+	t.Run(TypeJobCancel, func(t *testing.T) {
+		roundTrip(t, JobCancelPayload{JobID: "job-1"})
+	})
+	t.Run(TypeCapacity, func(t *testing.T) {
+		roundTrip(t, CapacityPayload{Slots: 4, FreeSlots: 1})
+	})
+	t.Run(TypeHeartbeat, func(t *testing.T) {
+		roundTrip(t, HeartbeatPayload{Slots: 4, FreeSlots: 2, JobIDs: []string{"job-1"}, Load1: 0.5, MemUsedPercent: 42})
+	})
+}
+
+func TestEncodeReply(t *testing.T) {
+	offer, err := Encode(JobOfferPayload{JobID: "job-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ack, err := EncodeReply(offer, AckPayload{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offer.ID == "" || ack.ID == "" || ack.ID == offer.ID {
+		t.Fatalf("messages need distinct IDs, got %q and %q", offer.ID, ack.ID)
+	}
+	if ack.ReplyTo != offer.ID {
+		t.Fatalf("reply_to %q, want %q", ack.ReplyTo, offer.ID)
+	}
+}
+
+func TestDecodeWrongType(t *testing.T) {
+	msg, err := Encode(JobStartedPayload{JobID: "job-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Decode[JobCancelPayload](msg); err == nil {
+		t.Fatal("decoding a JOB_STARTED message as JOB_CANCEL succeeded")
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	hello, rejection := Negotiate(AuthPayload{DeviceID: "d3v1ce", Version: Version + 1, Features: []string{FeatureResume, "teleport"}})
+	if rejection != nil {
+		t.Fatalf("newer provider rejected: %v", rejection)
+	}
+	if hello.Version != Version {
+		t.Errorf("negotiated version %d, want %d", hello.Version, Version)
+	}
+	if !reflect.DeepEqual(hello.Features, []string{FeatureResume}) {
+		t.Errorf("negotiated features %v, want [%s]", hello.Features, FeatureResume)
+	}
+	if hello.NodeID != "d3v1ce" {
+		t.Errorf("node ID %q, want d3v1ce", hello.NodeID)
+	}
+
+	_, rejection = Negotiate(AuthPayload{Version: MinVersion - 1})
+	if rejection == nil {
+		t.Fatal("provider below MinVersion accepted")
+	}
+	if rejection.Code != ErrCodeUnsupportedVersion || rejection.MinVersion != MinVersion || rejection.MaxVersion != Version {
+		t.Errorf("unexpected rejection %+v", rejection)
+	}
+}
@@ -1,26 +1,266 @@
 package protocol
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Protocol Versions: providers announce the highest version they speak in AUTH and the
+// orchestrator answers with the version both use
+const (
+	Version    = 1
+	MinVersion = 1
+)
+
+// Optional Features negotiated in AUTH/HELLO
+const (
+	FeatureJobLogs   = "job_logs"
+	FeatureJobCancel = "job_cancel"
+	FeatureHeartbeat = "heartbeat"
+	FeatureResume    = "resume"
+	FeatureAcks      = "acks"
+	FeatureOffers    = "offers" // offers are answered with JOB_ACCEPT or JOB_REJECT
+	FeatureChunks    = "chunks" // large outputs travel as binary chunks, see Chunk
+)
+
+// Features lists every optional feature this version of the package implements
+var Features = []string{FeatureJobLogs, FeatureJobCancel, FeatureHeartbeat, FeatureResume, FeatureAcks, FeatureOffers, FeatureChunks}
 
 // Message Types
 const (
-	TypeAuth      = "AUTH"
-	TypeJobOffer  = "JOB_OFFER"
-	TypeJobResult = "JOB_RESULT"
-	TypeHeartbeat = "HEARTBEAT"
+	TypeChallenge  = "CHALLENGE"
+	TypeAuth       = "AUTH"
+	TypeHello      = "HELLO"
+	TypeAck        = "ACK"
+	TypeError      = "ERROR"
+	TypeJobOffer   = "JOB_OFFER"
+	TypeJobAccept  = "JOB_ACCEPT"
+	TypeJobReject  = "JOB_REJECT"
+	TypeJobStarted = "JOB_STARTED"
+	TypeJobResult  = "JOB_RESULT"
+	TypeJobLog     = "JOB_LOG"
+	TypeJobCancel  = "JOB_CANCEL"
+	TypeCapacity   = "CAPACITY"
+	TypeHeartbeat  = "HEARTBEAT"
 )
 
-// Message is the standard wrapper for all WebSocket communications
+// Message is the standard wrapper for all WebSocket communications. ID identifies a message
+// for correlation; replies (HELLO, ACK, ERROR) carry the ID they answer in ReplyTo.
 type Message struct {
 	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	ReplyTo string          `json:"reply_to,omitempty"`
 	Payload json.RawMessage `json:"payload"`
 }
 
-// AuthPayload represents the payload for AUTH messages
+// ChallengePayload represents the payload for CHALLENGE messages, sent by the orchestrator on connect
+type ChallengePayload struct {
+	Nonce string `json:"nonce"`
+}
+
+// ChallengeMessage is the text a provider signs (EIP-191 personal_sign) to prove it owns its wallet
+func ChallengeMessage(nonce string) string {
+	return fmt.Sprintf("GridForce provider authentication\nNonce: %s", nonce)
+}
+
+// AuthPayload represents the payload for AUTH messages. Signature is the 0x-prefixed
+// personal_sign signature of ChallengeMessage(nonce) by WalletAddress. DeviceID is the
+// hex-encoded Ed25519 public key of the provider's device and DeviceSignature the hex-encoded
+// Ed25519 signature of the same message by that key.
 type AuthPayload struct {
-	DeviceID      string `json:"device_id"`
-	WalletAddress string `json:"wallet_address"`
-	OS            string `json:"os"`
-	Arch          string `json:"arch"`
-	CpuCores      int    `json:"cpu_cores"`
+	DeviceID        string `json:"device_id"`
+	WalletAddress   string `json:"wallet_address"`
+	OS              string `json:"os"`
+	Arch            string `json:"arch"`
+	CpuCores        int    `json:"cpu_cores"`
+	Signature       string `json:"signature"`
+	DeviceSignature string `json:"device_signature"`
+	// Slots is how many jobs the provider runs concurrently
+	Slots int `json:"slots"`
+	// Sandbox lists the relaxations of the hardened sandbox the provider accepts
+	Sandbox SandboxSpec `json:"sandbox"`
+	// Prices are what the provider charges for its resources; zero rates mean the
+	// orchestrator's default prices
+	Prices Prices `json:"prices"`
+	// JobIDs lists the jobs a reconnecting provider still holds (queued, running or with a
+	// result not yet delivered); they stay assigned to it
+	JobIDs []string `json:"job_ids,omitempty"`
+	// Version is the highest protocol version the provider speaks; Features the optional
+	// features it supports
+	Version  int      `json:"version"`
+	Features []string `json:"features,omitempty"`
+}
+
+// Prices are a provider's rates in credits per hour of each resource unit
+type Prices struct {
+	CoreHour     float64 `json:"core_hour"`      // per core-hour of CPU time
+	MemoryGBHour float64 `json:"memory_gb_hour"` // per GB-hour of memory
+	WallHour     float64 `json:"wall_hour"`      // per hour of wall time
+}
+
+// HelloPayload represents the payload for HELLO messages, the orchestrator's answer to a
+// successful AUTH with the negotiated protocol version and features. MaxMessageSize is the
+// largest message the orchestrator reads; larger values must be sent as chunks.
+type HelloPayload struct {
+	Version        int      `json:"version"`
+	Features       []string `json:"features,omitempty"`
+	NodeID         string   `json:"node_id"`
+	MaxMessageSize int64    `json:"max_message_size,omitempty"`
+}
+
+// AckPayload represents the payload for ACK messages, confirming that the message named in
+// ReplyTo was received and acted on
+type AckPayload struct{}
+
+// Error Codes carried in ERROR messages
+const (
+	ErrCodeUnsupportedVersion = "UNSUPPORTED_VERSION"
+	ErrCodeAuthFailed         = "AUTH_FAILED"
+	ErrCodeUnauthenticated    = "UNAUTHENTICATED"
+	ErrCodeBadMessage         = "BAD_MESSAGE"
+	ErrCodeUnknownJob         = "UNKNOWN_JOB"
+	ErrCodeNotAssigned        = "NOT_ASSIGNED"
+	ErrCodeDuplicateResult    = "DUPLICATE_RESULT"
+	ErrCodeInternal           = "INTERNAL"
+)
+
+// ErrorPayload represents the payload for ERROR messages. MinVersion and MaxVersion give
+// the versions the orchestrator speaks when the code is ErrCodeUnsupportedVersion.
+type ErrorPayload struct {
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	MinVersion int    `json:"min_version,omitempty"`
+	MaxVersion int    `json:"max_version,omitempty"`
+}
+
+func (e ErrorPayload) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// CapacityPayload represents the payload for CAPACITY messages, sent by providers whenever
+// a slot is taken or freed
+type CapacityPayload struct {
+	Slots     int `json:"slots"`
+	FreeSlots int `json:"free_slots"`
+}
+
+// HeartbeatPayload represents the payload for HEARTBEAT messages, sent periodically by providers
+type HeartbeatPayload struct {
+	Slots          int      `json:"slots"`
+	FreeSlots      int      `json:"free_slots"`
+	JobIDs         []string `json:"job_ids"` // jobs accepted and not yet reported
+	Load1          float64  `json:"load1"`
+	MemUsedPercent float64  `json:"mem_used_percent"`
+}
+
+// SandboxSpec lists relaxations of the hardened sandbox, either needed by a job or accepted by a provider
+type SandboxSpec struct {
+	Network        bool `json:"network,omitempty"`
+	WritableRootfs bool `json:"writable_rootfs,omitempty"`
+	RunAsRoot      bool `json:"run_as_root,omitempty"`
+}
+
+// Failure Reasons reported in JOB_RESULT messages
+const (
+	FailureError     = "ERROR"
+	FailureOOMKilled = "OOM_KILLED"
+	FailureTimeout   = "TIMEOUT"
+	FailurePolicy    = "POLICY_VIOLATION"
+	FailureExitCode  = "NON_ZERO_EXIT"
+	FailureCancelled = "CANCELLED"
+
+	// Recorded by the orchestrator for jobs the platform could not run
+	FailureNoProvider   = "NO_PROVIDER"
+	FailureProviderLost = "PROVIDER_LOST"
+)
+
+// ResourceLimits caps what a job may consume on the provider. Zero values mean unlimited.
+type ResourceLimits struct {
+	CPUs           float64 `json:"cpus,omitempty"`
+	MemoryMB       int64   `json:"memory_mb,omitempty"`
+	PidsLimit      int64   `json:"pids_limit,omitempty"`
+	ShmSizeMB      int64   `json:"shm_size_mb,omitempty"`
+	TimeoutSeconds int     `json:"timeout_seconds,omitempty"`
+}
+
+// JobOfferPayload represents the payload for JOB_OFFER messages
+type JobOfferPayload struct {
+	JobID     string         `json:"job_id"`
+	Image     string         `json:"image"`
+	Cmd       []string       `json:"cmd"`
+	Resources ResourceLimits `json:"resources"`
+	Sandbox   SandboxSpec    `json:"sandbox"`
+}
+
+// JobAcceptPayload represents the payload for JOB_ACCEPT messages, a provider's answer to
+// a JOB_OFFER it will run
+type JobAcceptPayload struct {
+	JobID string `json:"job_id"`
+}
+
+// Reject Reasons carried in JOB_REJECT messages
+const (
+	RejectBusy                  = "BUSY"
+	RejectImageNotAllowed       = "IMAGE_NOT_ALLOWED"
+	RejectInsufficientResources = "INSUFFICIENT_RESOURCES"
+	RejectPolicy                = "POLICY"
+	// RejectTimeout is recorded by the orchestrator when an offer is not answered in time
+	RejectTimeout = "TIMEOUT"
+)
+
+// JobRejectPayload represents the payload for JOB_REJECT messages, a provider's answer to
+// a JOB_OFFER it declines
+type JobRejectPayload struct {
+	JobID   string `json:"job_id"`
+	Reason  string `json:"reason"`
+	Message string `json:"message,omitempty"`
+}
+
+// JobStartedPayload represents the payload for JOB_STARTED messages
+type JobStartedPayload struct {
+	JobID string `json:"job_id"`
+}
+
+// JobCancelPayload represents the payload for JOB_CANCEL messages
+type JobCancelPayload struct {
+	JobID string `json:"job_id"`
+}
+
+// JobLogPayload represents the payload for JOB_LOG messages. Seq starts at 1 and increases
+// by one per chunk of a job, across both streams.
+type JobLogPayload struct {
+	JobID  string `json:"job_id"`
+	Seq    int64  `json:"seq"`
+	Stream string `json:"stream"`
+	Data   string `json:"data"`
+}
+
+// JobResultPayload represents the payload for JOB_RESULT messages. ExitCode is nil
+// when the container never ran; timestamps are zero for stages that were not reached.
+// With FeatureChunks, outputs too large to inline are sent as blobs beforehand and
+// StdoutBlob/StderrBlob name them in place of Stdout/Stderr.
+type JobResultPayload struct {
+	JobID           string    `json:"job_id"`
+	ExitCode        *int      `json:"exit_code,omitempty"`
+	Stdout          string    `json:"stdout"`
+	Stderr          string    `json:"stderr"`
+	StdoutBlob      string    `json:"stdout_blob,omitempty"`
+	StderrBlob      string    `json:"stderr_blob,omitempty"`
+	StdoutTruncated bool      `json:"stdout_truncated,omitempty"`
+	StderrTruncated bool      `json:"stderr_truncated,omitempty"`
+	ImageDigest     string    `json:"image_digest,omitempty"`
+	PulledAt        time.Time `json:"pulled_at"`
+	StartedAt       time.Time `json:"started_at"`
+	FinishedAt      time.Time `json:"finished_at"`
+	Error           string    `json:"error,omitempty"`
+	FailureReason   string    `json:"failure_reason,omitempty"`
+	Usage           *Usage    `json:"usage,omitempty"` // nil when the container never ran
+}
+
+// Usage is what a job's container consumed, metered by the provider
+type Usage struct {
+	CPUSeconds      float64 `json:"cpu_seconds"`       // core-seconds of CPU time
+	MemoryGBSeconds float64 `json:"memory_gb_seconds"` // memory in use integrated over the run
+	WallSeconds     float64 `json:"wall_seconds"`
 }